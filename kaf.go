@@ -1,18 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -26,17 +39,27 @@ const VERSION = "1.5.3"
  * (It all starts here)
  *
  *    way/
- * Get the user configuration, start the logs goroutine, and start the
- * server
+ * Get the user configuration, start the rate limiter, logs, and config
+ * reload goroutines, and start the server
  */
 func main() {
-	cfg := getConfig()
+	cfg, err := getConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 	if cfg == nil {
 		showHelp()
 		return
 	}
 
-	startServer(cfg, getLogsRoutine(cfg.dbloc))
+	cfgs := &atomic.Pointer[config]{}
+	cfgs.Store(cfg)
+
+	lim := getLimiter()
+	logsR := getLogsRoutine(cfgs, lim)
+	go reloadGo(cfgs, logsR)
+
+	startServer(cfgs, logsR, lim)
 }
 
 /*
@@ -46,21 +69,51 @@ func main() {
 /*    understand/
  * event logs are managed by a goroutine represented by this struct.
  * Because it is a goroutine, we communicate with it via a channel -
- * making requests for message logs
+ * making requests for message logs. Logs it has already opened can be
+ * found directly in it's registry. The offsets consumers have
+ * committed and the messages leased to groups of workers are managed by
+ * their own goroutines - as is following a leader (if we are a
+ * follower), which stops once we have been promoted from it. Archives
+ * the logs make are queued (z) to be compressed in the background.
  */
 type logsRoutine struct {
-	c chan logReq
+	c        chan logReq
+	t        chan txnReq
+	d        chan deleteReq
+	m        chan moveReq
+	o        chan offsetReq
+	l        chan leaseReq
+	f        chan promoteReq
+	z        chan string
+	reg      *registry
+	promoted *atomic.Pointer[string]
+}
+
+/*    understand/
+ * the open logs (by name) and what we know of closed logs. Any
+ * goroutine can look up an open log but only logsGo adds and removes
+ * them (loading and closing logs) so a log is never loaded twice.
+ */
+type registry struct {
+	mu      sync.RWMutex
+	logRs   map[string]*logRoutine
+	closed  map[string]logMeta
+	renamed map[string]string
 }
 
 /*    understand/
  * represents a request for a particular log routine from the main
  * logsRoutine goroutine. We can request for the log to be created if it
  * doesn't exist and we expect our response to be sent back via the
- * channel we provide (either the log itself or an error)
+ * channel we provide (either the log itself or an error). We can also
+ * ask for a log we opened to be closed again - if it hasn't been handed
+ * out since.
  */
 type logReq struct {
 	name   string
 	create bool
+	close  bool
+	since  time.Time
 
 	resp chan logReqResp
 }
@@ -70,32 +123,195 @@ type logReqResp struct {
 }
 
 /*    understand/
- * represents a request for all log routines currently being managed.
+ * represents a request to delete a log (archiving all it's messages
+ * first if asked). Responds with the message number archived upto.
+ */
+type deleteReq struct {
+	name    string
+	archive bool
+	resp    chan deleteReqResp
+}
+type deleteReqResp struct {
+	upto uint64
+	err  error
+}
+
+/*    understand/
+ * represents a request to rename (or copy) a log to a new name
+ */
+type moveReq struct {
+	name string
+	to   string
+	copy bool
+	resp chan error
+}
+
+/*    understand/
+ * represents a request to promote a follower - to stop following the
+ * leader and take over from it (even if we can't catch up with it
+ * first, when forced)
+ */
+type promoteReq struct {
+	force bool
+	resp  chan error
+}
+
+/*    understand/
+ * represents a request for a transaction - messages to be put into
+ * several logs (all or none of them). Responds with the message number
+ * given to each put. The settings of each log (for it's quota etc) are
+ * given and, when recovering a transaction, the intent record (and the
+ * time it was written).
+ */
+type txnReq struct {
+	puts []txnPut
+	cfgs map[string]logCfg
+	id   uint64
+	at   int64
+
+	resp chan txnReqResp
+}
+type txnPut struct {
+	log  string
+	data []byte
+	meta recMeta
+}
+type txnReqResp struct {
+	nums []uint64
+	id   uint64
+	at   int64
+	err  error
+}
+
+/*    understand/
+ * represents a request to commit the offset a consumer has read upto in
+ * a log, to get the offset a consumer has committed, to get all the
+ * committed offsets (by log and then by consumer), or to drop the
+ * offsets of a log (or just one of it's consumers) - moving them to
+ * another log if given. Offsets already saved in the _consumers log
+ * (replicated from a leader) just need noting.
+ */
+type offsetReq struct {
+	log      string
+	consumer string
+	upto     uint64
+	commit   bool
+	all      bool
+	drop     bool
+	to       string
+	saved    bool
+
+	resp chan offsetReqResp
+}
+type offsetReqResp struct {
+	upto    uint64
+	ok      bool
+	offsets map[string]map[string]uint64
+	err     error
+}
+
+/*    understand/
+ * the record of a committed offset saved in the _consumers log (keyed
+ * by <log>/<consumer>). Dropped offsets are saved as tombstones.
+ */
+type offsetRec struct {
+	Log      string `json:"log"`
+	Consumer string `json:"consumer"`
+	Upto     uint64 `json:"upto"`
+}
+
+/*    understand/
+ * represents a request to lease the next message of a log to a worker
+ * in a group - or, when acking, to mark a leased message done. Each
+ * group works through the log on it's own and a message is only leased
+ * to one worker of the group at a time. We can also move all the
+ * groups of a log to it's new name (or drop them if it was deleted).
+ */
+type leaseReq struct {
+	logR    *logRoutine
+	group   string
+	leasing leasing
+	ack     bool
+	num     uint64
+	id      string
+	log     string
+	to      string
+
+	resp chan leaseReqResp
+}
+type leaseReqResp struct {
+	msg   *msg
+	id    string
+	until time.Time
+	tries uint32
+	err   error
+}
+
+/*    understand/
+ * where a group is in a log. Every message before next has been leased
+ * and is either done or still leased - so the group is done upto the
+ * oldest message still leased (the floor).
+ */
+type leaseGroup struct {
+	next   uint64
+	floor  uint64
+	leases map[uint64]*leased
+}
+type leased struct {
+	id    string
+	until time.Time
+	tries uint32
+}
+
+/*    understand/
+ * the little we keep of a log that has been closed
  */
-type allLogsReq struct {
-	resp chan []*logRoutine
+type logMeta struct {
+	lastmsg uint64
+	closed  time.Time
 }
 
 /*    understand/
  * similar to logsRoutine, each message log is also handled by it's own
  * goroutine. We communicate to it via it's channels - either to get
  * message logs or to put a new message log or get info.
+ * Logs are opened when first needed and closed when they have been idle
+ * for a while - closing their goroutine and it's `done` channel so
+ * anyone still holding on to the log finds out (see send). When we
+ * change the log's archives from outside it's goroutine we flag it so
+ * it lists them again.
  */
 type logRoutine struct {
 	name string
 	get  chan getReq
 	put  chan putReq
 	ach  chan archiveReq
+	ret  chan retainReq
+	cmp  chan compactReq
+	txn  chan prepareReq
+	lst  chan listReq
 	stat chan statReq
+	stop chan stopReq
+	done chan struct{}
+
+	handed       atomic.Int64
+	archsChanged *atomic.Bool
 }
 
 /*    understand/
- * represents a request to a message log to get messages and hands over
- * a channel where we expect the responses
+ * represents a request to a message log to get messages (from the
+ * given message number or, if given, from the first message to arrive
+ * at or after the given time) and hands over a channel where we expect
+ * the responses. If a key is given, only messages with that key are
+ * returned (just the latest if no message number is given). Messages
+ * from before the log file can be read from it's archives.
  */
 type getReq struct {
-	num  uint32
-	resp chan getReqResp
+	num      uint64
+	since    int64
+	key      string
+	archived bool
+	resp     chan getReqResp
 }
 type getReqResp struct {
 	msgs []*msg
@@ -104,66 +320,206 @@ type getReqResp struct {
 
 /*    understand/
  * represents a request to a message log to put messages and hands over
- * a channel where we expect the response or error
+ * a channel where we expect the response or error. A conditional put
+ * only succeeds if the log's last message is the one expected. Messages
+ * replicated from a leader keep the number (and meta) it gave them.
  */
 type putReq struct {
-	data []byte
-	resp chan putReqResp
+	data   []byte
+	meta   recMeta
+	quota  quota
+	roll   rolling
+	expect uint64
+	cond   bool
+	num    uint64
+	resp   chan putReqResp
 }
 type putReqResp struct {
-	num uint32
-	err error
+	num      uint64
+	err      error
+	archived uint64
 }
 
 /*    understand/
- * represents a request to a message log archive the log and continue
- * with a new log.
+ * represents a request to a message log archive the log's segments upto
+ * the given message. Responds with the message number actually archived
+ * upto (0 if nothing was archived). An exact request is refused if the
+ * message is in the log file (with the message we could archive upto).
+ * The archives are compressed as they are made if asked.
  */
 type archiveReq struct {
-	upto uint32
-	resp chan achReqResp
+	upto     uint64
+	exact    bool
+	compress bool
+	resp     chan achReqResp
 }
 type achReqResp struct {
-	err error
+	upto uint64
+	err  error
+}
+
+/*    understand/
+ * represents a request to a message log to archive any messages beyond
+ * what it should keep. Responds with the message number archived upto
+ * (0 if nothing needed archiving).
+ */
+type retainReq struct {
+	keep keep
+	resp chan retainReqResp
+}
+type retainReqResp struct {
+	upto uint64
+	err  error
+}
+
+/*    understand/
+ * represents a request to a message log to compact itself - keeping only
+ * the latest message of each key. Responds with the number of messages
+ * removed.
+ */
+type compactReq struct {
+	resp chan compactReqResp
+}
+type compactReqResp struct {
+	removed uint64
+	err     error
+}
+
+/*    understand/
+ * represents a request to a message log to prepare for it's part of a
+ * transaction. The log responds if it can add the messages and then
+ * waits for the transaction to be committed (or aborted) on the next
+ * channel (refusing to be stopped meanwhile). When committing a
+ * recovered transaction, any messages the log already has are skipped.
+ */
+type prepareReq struct {
+	puts  []txnPut
+	quota quota
+	roll  rolling
+	resp  chan error
+	next  chan commitReq
+}
+type commitReq struct {
+	commit  bool
+	id      uint64
+	at      int64
+	recover bool
+	resp    chan txnPutsResp
+}
+type txnPutsResp struct {
+	nums []uint64
+	err  error
+}
+
+/*    understand/
+ * represents a request to a message log to list it's archives (with
+ * the messages in each)
+ */
+type listReq struct {
+	resp chan listReqResp
+}
+type listReqResp struct {
+	archives []archiveInfo
+	err      error
+}
+type archiveInfo struct {
+	Name       string `json:"name"`
+	At         string `json:"at"`
+	Size       int64  `json:"size"`
+	Compressed bool   `json:"compressed,omitempty"`
+	First      uint64 `json:"first,omitempty"`
+	Last       uint64 `json:"last,omitempty"`
+	Msgs       int    `json:"msgs"`
 }
 
 /*    understand/
- * represents a request to a message log get stats
+ * represents a request to a message log get stats (and reset it's
+ * counts unless we are only peeking)
  */
 type statReq struct {
+	peek bool
 	resp chan stats
 }
 
+/*    understand/
+ * represents a request to a message log to close if it has been idle
+ * for the given time - responding if it has closed (and it's last
+ * message)
+ */
+type stopReq struct {
+	idle time.Duration
+	resp chan stopReqResp
+}
+type stopReqResp struct {
+	stopped bool
+	lastmsg uint64
+}
+
 /*    understand/
  * represents a message in the event log
  */
 type msg struct {
 	offset int64
-	start  uint32
-	num    uint32
-	sz     uint32
+	start  uint64
+	num    uint64
+	sz     uint64
+	meta   recMeta
 	data   []byte
 }
 
 /*    understand/
- * hold an offset to the message in the message log so it's easy to get
- * to and read
+ * extra information about a message stored in it's record header
+ */
+type recMeta struct {
+	at       int64
+	key      string
+	hdrs     map[string]string
+	producer string
+	seq      uint64
+	txn      uint64
+}
+
+/*    understand/
+ * the sequence number a producer sent with a message and the number
+ * the message was given
+ */
+type seqNum struct {
+	seq uint64
+	num uint64
+}
+
+/*    understand/
+ * hold an offset to the message in the segment of the message log it is
+ * in so it's easy to get to and read (along with when it arrived)
  */
 type msgOff struct {
-	num    uint32
+	num    uint64
 	offset int64
+	at     int64
+	seg    *segment
 }
 
 /*    understand/
- * important info on the message log
+ * important info on the message log (including the message numbers of
+ * every key, the latest sequence numbers of every producer, and the
+ * archives that have been read). Keys are only loaded when first
+ * needed (nil till then) as it means reading every record header. The
+ * list of archives is kept till they change (nil till then).
  */
 type msgLog struct {
 	name    string
 	loc     string
-	f       *os.File
+	segs    []*segment
 	size    int64
-	lastmsg uint32
-	msgOs   []msgOff
+	start   uint64
+	lastmsg uint64
+	keys    map[string][]uint64
+
+	producers    map[string][]seqNum
+	archives     map[string]*archived
+	archList     []*archived
+	archsChanged *atomic.Bool
+	toCompress   chan string
 
 	getCount uint32
 	putCount uint32
@@ -171,12 +527,111 @@ type msgLog struct {
 	errCount uint32
 }
 
+/*    understand/
+ * a message log is stored in segment files - the latest (active)
+ * segment is the log file itself and older segments are rolled over to
+ * --<name>--seg-<start> files next to it. Each segment is a log file in
+ * it's own right, starting after the given message number. We keep the
+ * offsets of only every IndexEvery'th message of a segment (it's index)
+ * along with when it's first and last messages arrived. If saving the
+ * index fails, it's file is missing entries (noIdx) so we stop saving
+ * to it and leave it to be rebuilt.
+ */
+type segment struct {
+	loc    string
+	f      *os.File
+	start  uint64
+	size   int64
+	n      int
+	at     int64
+	last   uint64
+	lastAt int64
+	idx    []msgOff
+	noIdx  bool
+}
+
+/*    understand/
+ * a position in the message log - the message's header info, the
+ * segment it is in, and it's position in that segment
+ */
+type msgPos struct {
+	m   msg
+	si  int
+	ord int
+}
+
+/*    understand/
+ * an archived file of a message log - the message number it starts
+ * after, and (once it has been read) the offsets of it's messages. We
+ * don't keep archives open so they can still be moved or deleted.
+ * Compressed archives are uncompressed into a private (already
+ * removed) file the first time they are read - which we keep while it
+ * is one of the latest read.
+ */
+type archived struct {
+	fname      string
+	t          time.Time
+	size       int64
+	compressed bool
+	raw        *os.File
+	rawUsed    time.Time
+	start      uint64
+	msgOs      []msgOff
+}
+
 /*    understand/
  * relevant stats for a message log are available in the msgLog
  * structure
  */
 type stats msgLog
 
+/*    understand/
+ * an administrative operation (archival etc) recorded in the audit log
+ */
+type auditEvent struct {
+	At     string            `json:"at"`
+	Op     string            `json:"op"`
+	Who    string            `json:"who"`
+	Addr   string            `json:"addr,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	Result string            `json:"result"`
+}
+
+/*    understand/
+ * rate limits are tracked by a goroutine represented by this struct.
+ * We ask it to take a request's share of the limits and it tells us how
+ * long to wait if any limit has run out. It also keeps count of the
+ * requests it has throttled.
+ */
+type limiter struct {
+	c chan limitReq
+	t chan chan uint32
+}
+
+/*    understand/
+ * represents a request from a client for a log with the given size of
+ * data, and the limits that apply to the client and the log
+ */
+type limitReq struct {
+	client  string
+	log     string
+	sz      int64
+	clientL limits
+	logL    limits
+
+	resp chan time.Duration
+}
+
+/*    understand/
+ * a token bucket that fills up at the given rate and holds at most one
+ * second's worth of tokens
+ */
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
 /*
  * Data File constants
  */
@@ -184,818 +639,5895 @@ const DBHeader = "KAF_DB|v1|"
 const RecHeaderPfx = "\nKAF_MSG|"
 const RecHeaderSfx = "\n"
 const RespHeaderPfx = "KAF_MSGS|v1"
+const MaxRecHeader = 64 * 1024
+const MaxKey = 1024
+const ProducerWindow = 5
+const SegmentPfx = "seg-"
+const IdxHeader = "KAF_IDX|v1|"
+const IndexEvery = 64
+const DefaultSegmentSize = 64 * 1024 * 1024
+const DefaultIdle = 10 * time.Minute
+const ColdRetainEvery = time.Hour
+const DownloadTimeout = 30 * time.Second
+const MaxRawArchives = 4
+const MaxCompressQueue = 64
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+/*
+ * Errors
+ */
+var errLogFull = errors.New("log quota exceeded")
+var errDuplicate = errors.New("duplicate message")
+var errBadSeq = errors.New("sequence number out of order")
+var errNotExpected = errors.New("last message is not the one expected")
+var errNotLeased = errors.New("message is not leased with the given lease")
+var errLogExists = errors.New("log already exists")
+var errLogClosed = errors.New("log was closed - please retry")
+var errNoLog = errors.New("log not found")
+var errLogBusy = errors.New("log is in a transaction - please retry")
+var errTxnPending = errors.New("transaction not complete - it will be finished later")
+var errBehind = errors.New("could not catch up with the leader")
+var errDiverged = errors.New("log differs from the leader's")
+var errInLogFile = errors.New("message is in the log file - archive upto it's last message or before it")
+var errNotAdmin = errors.New("only admins can do this")
+var errFollower = errors.New("this is a read only follower - send it to the leader")
+
+/*    understand/
+ * the error for a log that has been renamed - giving the new name
+ */
+type renamedErr struct{ to string }
+
+func (e renamedErr) Error() string {
+	return "log was renamed to " + e.to
+}
+
+/*
+ * Reserved logs
+ */
+const AuditLog = "_audit"
+const TxnLog = "_txn"
+const ConsumerLog = "_consumers"
+
+/*
+ * Failed authentication attempts we take (and audit) per second from
+ * each host
+ */
+const AuthFailRPS = 1
+
+/*
+ * Follower constants
+ */
+const FollowEvery = time.Second
+const PromotedFile = ".promoted"
+
+/*
+ * Leasing defaults
+ */
+const LeaseTimeout = 30 * time.Second
+const LeaseRetries = 3
+const DeadLogSfx = ".dead"
+const GroupPfx = "group:"
+
+/*
+ * Transaction intent constants
+ */
+const TxnHeaderPfx = "KAF_TXN|v1"
+const TxnPutPfx = "KAF_PUT|"
+const TxnDonePfx = "KAF_TXN_DONE|"
 
 /*    way/
- * Load configuration from the command line
+ * Load configuration from the command line and the config file (if
+ * given)
  */
-func getConfig() *config {
-	if len(os.Args) != 3 {
-		return nil
+func getConfig() (*config, error) {
+	if len(os.Args) != 3 && len(os.Args) != 4 {
+		return nil, nil
 	}
-	return &config{
+	cfg := &config{
 		addr:  os.Args[1],
 		dbloc: os.Args[2],
 	}
+	if len(os.Args) == 4 {
+		cfg.file = os.Args[3]
+	}
+	return loadConfig(cfg)
 }
 
 func showHelp() {
 	fmt.Println("kaf: Simple Event Store")
 	fmt.Println("eg: go run kaf 127.0.0.1:7749 ../kafdata")
-	fmt.Println("    go run kaf <addr> <path to data folder>")
+	fmt.Println("    go run kaf <addr> <path to data folder> [config file]")
 	fmt.Println("version: " + VERSION)
 }
 
 /*    understand/
- * We use a goroutine as the single point of synchoronous
- * contact for all other goroutines to get access to
- * message logs - it creates/manages all of them
+ * the config file is a simple, human-friendly, list of settings:
+ *    # comment
+ *    name = value
+ * Settings for logs are put under a section with the name of the log
+ * (or '*' for all logs):
+ *    [orders]
+ *    rps = 100
  *
  *    way/
- * start up the goroutine, load all logs from disk, and set up the stat tracker
+ * walk the lines of the file, gathering global settings and the
+ * settings of each log section, then work out each log's settings by
+ * applying the '*' section first and then it's own section.
  */
-func getLogsRoutine(dbloc string) logsRoutine {
-
-	c := make(chan logReq)
-	a := make(chan allLogsReq)
-	go logsGo(dbloc, c, a)
-
-	logsR := logsRoutine{c}
+func loadConfig(base *config) (*config, error) {
+	cfg := &config{
+		addr:   base.addr,
+		dbloc:  base.dbloc,
+		file:   base.file,
+		tokens: map[string]string{},
+		admins: map[string]bool{},
+		idle:   DefaultIdle,
+		logs:   map[string]logCfg{},
+	}
+	if cfg.file == "" {
+		return cfg, nil
+	}
 
-	err := loadAllLogs(dbloc, logsR)
+	data, err := ioutil.ReadFile(cfg.file)
 	if err != nil {
-		log.Println(err)
-		log.Panic("Failed loading all logs from", dbloc)
+		return nil, err
 	}
 
-	go statsGo(logsR, a)
-
-	return logsR
-}
-
-/*    understand/
- * manages all log routines, handling creating new routines and
- * returning routines as requested
- */
-func logsGo(dbloc string, c chan logReq, a chan allLogsReq) {
-	var logRs []*logRoutine
-	for {
-		select {
-		case req := <-c:
-			logR := findLogR(logRs, req.name)
-			if logR != nil {
-				req.resp <- logReqResp{logR, nil}
-				continue
+	sections := map[string]map[string]string{}
+	sec := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: invalid section", cfg.file, i+1)
 			}
-
-			loc := path.Join(dbloc, req.name)
-
-			if req.create && !fileExists(loc) {
-				createLogFile(loc, 0)
+			sec = strings.TrimSpace(line[1 : len(line)-1])
+			if len(sec) == 0 {
+				return nil, fmt.Errorf("%s:%d: missing section name", cfg.file, i+1)
 			}
-
-			if fileExists(loc) {
-
-				logR, err := loadLogR(req.name, loc)
-				if err != nil {
-					req.resp <- logReqResp{nil, err}
-				} else {
-					logRs = append(logRs, logR)
-					req.resp <- logReqResp{logR, nil}
-				}
-			} else {
-
-				req.resp <- logReqResp{}
+			if sections[sec] == nil {
+				sections[sec] = map[string]string{}
 			}
-
-		case req := <-a:
-			req.resp <- logRs
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected 'name = value'", cfg.file, i+1)
+		}
+		k = strings.TrimSpace(k)
+		v = strings.TrimSpace(v)
+		if sec == "" {
+			err = setGlobalCfg(cfg, k, v)
+		} else {
+			sections[sec][k] = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", cfg.file, i+1, err)
 		}
 	}
-}
 
-/*    way/
- * load all existing logs from disk
- */
-func loadAllLogs(dbloc string, logsR logsRoutine) error {
-	files, err := ioutil.ReadDir(dbloc)
+	cfg.deflog, err = getLogCfg(sections["*"])
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%s: [*] %s", cfg.file, err)
 	}
-
-	for _, f := range files {
-		if isHidden(f.Name()) {
+	for name, kv := range sections {
+		if name == "*" {
 			continue
 		}
-		_, err := getLog(f.Name(), logsR, true)
+		lc, err := getLogCfg(sections["*"], kv)
 		if err != nil {
-			return errors.New(fmt.Sprintf("%s: %s", f.Name(), err.Error()))
+			return nil, fmt.Errorf("%s: [%s] %s", cfg.file, name, err)
 		}
+		cfg.logs[name] = lc
 	}
 
-	return nil
+	return cfg, nil
 }
 
 /*    way/
- * periodically post statistics of all logs that have activity
+ * set a global config value:
+ *    token.<name> = <secret>
+ *    admin = <names of tokens allowed to manage logs>
+ *    client.rps = <requests per second allowed for each client>
+ *    client.bps = <put bytes per second allowed for each client>
+ *    idle = <time after which an unused log is closed> | never
+ *    renamed = error | redirect (requests for renamed logs)
+ *    follow = <url of the leader to follow>
+ *    follow.token = <token to present to the leader>
  */
-func statsGo(logsR logsRoutine, a chan allLogsReq) {
-	ticker := time.NewTicker(5 * time.Minute)
-	c := make(chan stats)
-	r := make(chan []*logRoutine)
-	var b strings.Builder
-
-	var statCount uint32 = 0
-	for {
-		start := time.Now()
-
-		<-ticker.C
-		statCount++
-
-		allstats := []stats{}
-		a <- allLogsReq{r}
-		for _, logR := range <-r {
-			logR.stat <- statReq{resp: c}
-			stats := <-c
-			if stats.name != "_kaf" && hasActivity(stats) {
-				allstats = append(allstats, stats)
-			}
+func setGlobalCfg(cfg *config, k, v string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(k, "token."):
+		name := k[len("token."):]
+		if len(name) == 0 || len(v) == 0 {
+			return errors.New("token needs a name and a value")
 		}
-
-		end := time.Now()
-
-		if len(allstats) == 0 {
-			continue
+		cfg.tokens[v] = name
+	case k == "admin":
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				cfg.admins[name] = true
+			}
 		}
-
-		logR, err := getLog("_kaf", logsR, true)
-		if err != nil {
-			log.Println(err)
-			continue
+	case k == "client.rps":
+		cfg.client.rps, err = parseRate(v)
+	case k == "client.bps":
+		cfg.client.bps, err = parseSize(v)
+	case k == "idle":
+		if v == "never" {
+			cfg.idle = 0
+		} else {
+			cfg.idle, err = parseAge(v)
 		}
-
-		statsJSON(allstats, statCount, start, end, &b)
-
-		c := make(chan putReqResp)
-		logR.put <- putReq{
-			data: []byte(b.String()),
-			resp: c,
+	case k == "follow":
+		u, e := url.Parse(v)
+		if e != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			err = errors.New("should be the leader's http(s) url")
 		}
-		resp := <-c
-		if resp.err != nil {
-			log.Println(err)
+		cfg.follow = strings.TrimSuffix(v, "/")
+	case k == "follow.token":
+		cfg.ftoken = v
+	case k == "renamed":
+		switch v {
+		case "error":
+			cfg.redirect = false
+		case "redirect":
+			cfg.redirect = true
+		default:
+			err = errors.New("should be error or redirect")
 		}
+	default:
+		return fmt.Errorf("unknown setting '%s'", k)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", k, err)
+	}
+	return nil
+}
 
+/*    way/
+ * apply each set of log settings in turn:
+ *    rps = <requests per second allowed for the log>
+ *    bps = <put bytes per second allowed for the log>
+ *    maxsize = <maximum size of the log file>
+ *    maxmsgs = <maximum number of messages in the log>
+ *    onfull = reject | archive
+ *    keep.size = <size of the log to keep - older messages are archived>
+ *    keep.msgs = <number of messages to keep - older are archived>
+ *    keep.age = <age of messages to keep - older are archived>
+ *    archives.compress = <age after which archives are compressed> | now
+ *    archives.delete = <age after which archives are deleted>
+ *    archives.read = true | false
+ *    compact = true | false
+ *    segment.size = <size at which the log file is rolled over>
+ *    segment.age = <age at which the log file is rolled over>
+ *    lease.timeout = <how long a message is leased for>
+ *    lease.retries = <times a message is leased again before it's dead>
+ *    lease.dead = <name of the dead letter log>
+ */
+func getLogCfg(kvs ...map[string]string) (logCfg, error) {
+	var lc logCfg
+	for _, kv := range kvs {
+		for k, v := range kv {
+			var err error
+			switch k {
+			case "rps":
+				lc.limits.rps, err = parseRate(v)
+			case "bps":
+				lc.limits.bps, err = parseSize(v)
+			case "maxsize":
+				var sz float64
+				sz, err = parseSize(v)
+				lc.quota.size = int64(sz)
+			case "maxmsgs":
+				n, e := strconv.ParseUint(v, 10, 64)
+				if e != nil {
+					err = errors.New("invalid number")
+				}
+				lc.quota.msgs = n
+			case "keep.size":
+				var sz float64
+				sz, err = parseSize(v)
+				lc.keep.size = int64(sz)
+			case "keep.msgs":
+				n, e := strconv.ParseUint(v, 10, 64)
+				if e != nil {
+					err = errors.New("invalid number")
+				}
+				lc.keep.msgs = n
+			case "keep.age":
+				lc.keep.age, err = parseAge(v)
+			case "archives.compress":
+				if v == "now" {
+					lc.keep.compressNow = true
+					lc.keep.compressAfter = 0
+				} else {
+					lc.keep.compressNow = false
+					lc.keep.compressAfter, err = parseAge(v)
+				}
+			case "archives.delete":
+				lc.keep.deleteAfter, err = parseAge(v)
+			case "segment.size":
+				var sz float64
+				sz, err = parseSize(v)
+				lc.roll.size = int64(sz)
+			case "segment.age":
+				lc.roll.age, err = parseAge(v)
+			case "lease.timeout":
+				lc.leasing.timeout, err = parseAge(v)
+			case "lease.retries":
+				n, e := strconv.ParseUint(v, 10, 32)
+				if e != nil {
+					err = errors.New("invalid number")
+				}
+				lc.leasing.retries = uint32(n)
+			case "lease.dead":
+				if isHidden(v) || strings.Contains(v, "/") {
+					err = errors.New("invalid log name")
+				}
+				lc.leasing.dead = v
+			case "archives.read":
+				lc.readArchives, err = strconv.ParseBool(v)
+				if err != nil {
+					err = errors.New("expected 'true' or 'false'")
+				}
+			case "compact":
+				lc.compact, err = strconv.ParseBool(v)
+				if err != nil {
+					err = errors.New("expected 'true' or 'false'")
+				}
+			case "onfull":
+				switch v {
+				case "reject":
+					lc.quota.archive = false
+				case "archive":
+					lc.quota.archive = true
+				default:
+					err = errors.New("expected 'reject' or 'archive'")
+				}
+			default:
+				return lc, fmt.Errorf("unknown setting '%s'", k)
+			}
+			if err != nil {
+				return lc, fmt.Errorf("%s: %s", k, err)
+			}
+		}
 	}
+	lc.quota.compress = lc.keep.compressNow
+	return lc, nil
 }
 
 /*    understand/
- * ignore empty filenames, dot files, and 'archived' files i(those
- * starting with --)
+ * the settings for the given log ('*' settings if it has none of it's
+ * own)
  */
-func isHidden(name string) bool {
-	if len(name) == 0 {
-		return true
-	}
-	if name[0] == '.' {
-		return true
+func (cfg *config) logCfg(name string) logCfg {
+	if lc, ok := cfg.logs[name]; ok {
+		return lc
 	}
-	if strings.HasPrefix(name, "--") {
-		return true
-	}
-	return false
+	return cfg.deflog
 }
 
-/*    understand/
- * we count a log as having activity if it has any get or put requests
- * or any errors
- */
-func hasActivity(stats stats) bool {
-	return stats.getCount+stats.putCount > 0 || stats.errCount > 0
+func parseRate(v string) (float64, error) {
+	r, err := strconv.ParseFloat(v, 64)
+	if err != nil || r < 0 {
+		return 0, errors.New("invalid number")
+	}
+	return r, nil
 }
 
 /*    way/
- * convert all the stats received to a JSON report
+ * parse a size given in bytes or with a KB/MB/GB/TB suffix
  */
-func statsJSON(allstats []stats,
-	statCount uint32, start, end time.Time,
-	b *strings.Builder) {
-
-	b.Reset()
-
-	b.WriteString(`{"start":"`)
-	b.WriteString(start.UTC().Format(time.RFC3339))
-	b.WriteString(`","end":"`)
-	b.WriteString(end.UTC().Format(time.RFC3339))
-	fmt.Fprintf(b, `","statno":%d,"logs":[`, statCount)
-
-	for i, stats := range allstats {
-
-		if stats.errCount > 0 {
-			fmt.Fprintf(b,
-				`{"name":"%s","last":%d,"gets":%d,"puts":%d,"errs":%d}`,
-				stats.name,
-				stats.lastmsg,
-				stats.getCount, stats.putCount,
-				stats.errCount)
-		} else if hasActivity(stats) {
-			fmt.Fprintf(b,
-				`{"name":"%s","last":%d,"gets":%d,"puts":%d}`,
-				stats.name,
-				stats.lastmsg,
-				stats.getCount, stats.putCount)
-		} else {
-			fmt.Fprintf(b,
-				`{"name":"%s","last":%d}`,
-				stats.name,
-				stats.lastmsg)
-		}
-
-		if i != len(allstats)-1 {
-			b.WriteRune(',')
+func parseSize(v string) (float64, error) {
+	mul := 1.0
+	u := strings.ToUpper(v)
+	for i, sfx := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(u, sfx) {
+			mul = math.Pow(1024, float64(i+1))
+			v = strings.TrimSpace(v[:len(v)-len(sfx)])
+			break
 		}
 	}
-
-	b.WriteString("]}")
-}
-
-func fileExists(loc string) bool {
-	info, err := os.Stat(loc)
-	if os.IsNotExist(err) {
-		return false
-	}
-	return !info.IsDir()
-}
-
-func findLogR(logRs []*logRoutine, name string) *logRoutine {
-	for _, l := range logRs {
-		if l.name == name {
-			return l
-		}
+	n, err := parseRate(v)
+	if err != nil {
+		return 0, errors.New("invalid size")
 	}
-	return nil
+	return n * mul, nil
 }
 
 /*    way/
- * create the requested db file with header.
+ * parse an age given as a duration (eg: 12h) or in days (eg: 7d)
  */
-func createLogFile(loc string, lastmsg uint32) error {
-	f, err := os.OpenFile(loc, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return err
+func parseAge(v string) (time.Duration, error) {
+	if strings.HasSuffix(v, "d") {
+		d, err := strconv.ParseFloat(v[:len(v)-1], 64)
+		if err != nil || d < 0 {
+			return 0, errors.New("invalid age")
+		}
+		return time.Duration(d * float64(24*time.Hour)), nil
 	}
-	defer f.Close()
-	no := strconv.FormatUint(uint64(lastmsg), 10)
-	f.Write([]byte(DBHeader))
-	f.Write([]byte(no))
-	return nil
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid age")
+	}
+	return d, nil
 }
 
 /*    way/
- * load records from the log file and, and set up a goroutine to handle requests
+ * reload the config file whenever we get a SIGHUP, keeping the
+ * existing config if the new one has problems
  */
-func loadLogR(name, loc string) (*logRoutine, error) {
-	msglog := &msgLog{
-		name: name,
-		loc:  loc,
-	}
-	err := loadLogFile(msglog)
-	if err != nil {
-		return nil, err
-	}
-
-	g := make(chan getReq)
-	p := make(chan putReq)
-	s := make(chan statReq)
-	a := make(chan archiveReq)
-	go func() {
-		for {
-			select {
-			case req := <-g:
-				req.resp <- get_(req.num, msglog)
-			case req := <-p:
-				req.resp <- put_(req.data, msglog)
-			case req := <-a:
-				req.resp <- archive_(req.upto, msglog)
-			case req := <-s:
-				stats := stats(*msglog)
-				msglog.getCount = 0
-				msglog.putCount = 0
-				msglog.achCount = 0
-				msglog.errCount = 0
-
-				req.resp <- stats
-			}
+func reloadGo(cfgs *atomic.Pointer[config], logsR logsRoutine) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		curr := cfgs.Load()
+		cfg, err := loadConfig(curr)
+		if err != nil {
+			log.Println("reload:", err)
+		} else {
+			cfgs.Store(cfg)
+			log.Println("Reloaded config from", cfg.file)
 		}
-	}()
-
-	return &logRoutine{
-		name: name,
-		get:  g,
-		put:  p,
-		ach:  a,
-		stat: s,
-	}, nil
+		audit(curr, logsR, "reload", nil, map[string]string{"file": curr.file}, err)
+	}
 }
 
-/*    way/
- * keep track of the message offset from which we want to copy,
- * close/clean the existing message log, rename the existing file,
- * create a new log file, copy any existing messages and reload it.
+/*    understand/
+ * We use a goroutine as the single point of synchoronous
+ * contact for all other goroutines to get access to
+ * message logs - it creates/manages all of them
+ *
+ *    way/
+ * start up the goroutine (which loads logs from disk as they are
+ * needed), finish any transactions left pending and start running
+ * transactions, and set up the stat tracker and retention goroutines
  */
-func archive_(upto uint32, msglog *msgLog) achReqResp {
-	msglog.achCount++
+func getLogsRoutine(cfgs *atomic.Pointer[config], lim limiter) logsRoutine {
+	dbloc := cfgs.Load().dbloc
 
-	if len(msglog.msgOs) == 0 {
-		return achReqResp{errors.New("empty logfile: nothing toarchive")}
-	}
-	if upto == 0 {
-		return achReqResp{errors.New("message to archive upto not given")}
+	c := make(chan logReq)
+	t := make(chan txnReq)
+	d := make(chan deleteReq)
+	m := make(chan moveReq)
+	o := make(chan offsetReq)
+	l := make(chan leaseReq)
+	f := make(chan promoteReq)
+	z := make(chan string, MaxCompressQueue)
+	renamed, err := loadRenames(dbloc)
+	if err != nil {
+		log.Println(err)
+		log.Panic("Failed loading renamed logs from", dbloc)
 	}
-
-	ndx := findMsgNdx(msglog.msgOs, upto)
-	if ndx >= uint32(len(msglog.msgOs)) {
-		upto = msglog.lastmsg
+	reg := &registry{
+		logRs:   map[string]*logRoutine{},
+		closed:  map[string]logMeta{},
+		renamed: renamed,
 	}
+	go logsGo(cfgs, reg, c, d, m, z)
 
-	var firstMsg msgOff
-	if ndx < uint32(len(msglog.msgOs)) {
-		firstMsg = msglog.msgOs[ndx]
-		if firstMsg.num == upto {
-			firstMsg.num = 0
-			firstMsg.offset = 0
-			ndx++
-		}
-		if ndx < uint32(len(msglog.msgOs)) {
-			firstMsg = msglog.msgOs[ndx]
-		}
+	promoted := &atomic.Pointer[string]{}
+	if data, err := ioutil.ReadFile(filepath.Join(dbloc, PromotedFile)); err == nil {
+		leader := strings.TrimSpace(string(data))
+		promoted.Store(&leader)
 	}
 
-	clearMsgLog(msglog)
-
-	t := time.Now().UTC().Format("2006-01-02T15_04_05Z07_00")
-	aname := fmt.Sprintf("--%s--%s", msglog.name, t)
-	aloc := filepath.Join(filepath.Dir(msglog.loc), aname)
-	if err := os.Rename(msglog.loc, aloc); err != nil {
-		msglog.errCount++
-		return achReqResp{err}
-	}
+	logsR := logsRoutine{c, t, d, m, o, l, f, z, reg, promoted}
 
-	createLogFile(msglog.loc, upto)
-	src, err := os.OpenFile(aloc, os.O_RDWR, 0644)
+	pending, err := pendingTxns(logsR)
 	if err != nil {
-		return achReqResp{err}
+		log.Println(err)
+		log.Panic("Failed recovering transactions in", dbloc)
 	}
-	defer src.Close()
-	dst, err := os.OpenFile(msglog.loc, os.O_RDWR, 0644)
+	go txnsGo(t, finishTxns(pending, logsR), logsR)
+
+	offsets, err := loadOffsets(logsR)
 	if err != nil {
-		return achReqResp{err}
+		log.Println(err)
+		log.Panic("Failed loading consumer offsets from", dbloc)
 	}
-	defer dst.Close()
+	go consumersGo(offsets, o, logsR)
+	go leasesGo(l, logsR)
 
-	if firstMsg.offset > 0 {
-		if _, err := src.Seek(firstMsg.offset, 0); err != nil {
-			return achReqResp{err}
-		}
-		if _, err := dst.Seek(0, 2); err != nil {
-			return achReqResp{err}
-		}
-		buf := make([]byte, 4096)
-		for {
-			n, err := src.Read(buf)
-			if err != nil && err != io.EOF {
-				return achReqResp{err}
-			}
-			if n == 0 {
-				break
-			}
-			if _, err := dst.Write(buf[:n]); err != nil {
-				return achReqResp{err}
-			}
-		}
-	}
+	go statsGo(logsR, lim)
+	go retentionGo(cfgs, logsR)
+	go followGo(cfgs, f, logsR)
 
-	return achReqResp{loadLogFile(msglog)}
+	return logsR
 }
 
-/*    problem/
- * return a few messages (max 5 || size < 3200) to the user
- *    way/
- * find the index of the first message >= the number and then walk the
- * next few messages, stopping when too big or out of bounds
- * NB: Why 3200? We want sizes to be small enough so they fit the
- * initial congestion window of TCP - we could probably go (much?) higher
- * but we don't expect large data records anyway so 3200 is reasonable.
+/*    understand/
+ * manages all log routines, handling creating new routines and
+ * returning routines as requested. Logs are loaded when first asked
+ * for, and periodically we close those that have not been asked for (or
+ * used) for the idle time - remembering only their last message.
  */
-func get_(num uint32, msglog *msgLog) getReqResp {
-	msglog.getCount++
+func logsGo(cfgs *atomic.Pointer[config], reg *registry, c chan logReq, d chan deleteReq, m chan moveReq, z chan string) {
+	dbloc := cfgs.Load().dbloc
+	ticker := time.NewTicker(time.Minute)
+
+	getLogR := func(name string, create bool) (*logRoutine, error) {
+		logR := reg.find(name)
+		if logR != nil {
+			return logR, nil
+		}
 
-	ndx := findMsgNdx(msglog.msgOs, num)
+		loc := path.Join(dbloc, name)
 
-	var msgs []*msg
-	var i, tot, l uint32
-	l = uint32(len(msglog.msgOs))
-	for ; i < 5 && ndx+i < l; i++ {
-		mo := msglog.msgOs[ndx+i]
-		msg, err := readMsg(mo, msglog.f)
+		if create && !fileExists(loc) {
+			if to, ok := reg.renamedTo(name); ok {
+				return nil, renamedErr{to}
+			}
+			createLogFile(loc, 0)
+		}
+
+		if !fileExists(loc) {
+			return nil, nil
+		}
+
+		logR, err := loadLogR(name, loc, z)
 		if err != nil {
-			msglog.errCount++
-			return getReqResp{nil, err}
+			return nil, err
 		}
-		msgs = append(msgs, msg)
-		tot += msg.sz
-		if tot >= 3200 {
-			break
+		if _, ok := reg.renamedTo(name); ok {
+			forgetRename(name, reg, dbloc)
 		}
+		logR.handed.Store(time.Now().UnixNano())
+		reg.add(logR)
+		return logR, nil
 	}
 
-	return getReqResp{msgs, nil}
-}
+	for {
+		select {
+		case req := <-c:
+			if req.close {
+				closeLogR(req.name, time.Since(req.since), 0, reg)
+				req.resp <- logReqResp{}
+				continue
+			}
+			logR, err := getLogR(req.name, req.create)
+			req.resp <- logReqResp{logR, err}
 
-/*    way/
- * binary search for first index that matches the number passed in
- */
-func findMsgNdx(a []msgOff, num uint32) uint32 {
-	if len(a) == 0 {
-		return 0
-	}
-	s := uint32(0)
-	e := uint32(len(a) - 1)
-	for s <= e {
-		if num <= a[s].num {
-			return s
-		}
-		if a[e].num < num {
-			break
-		}
-		m := (s + e) / 2
-		if m == s {
-			return e
-		}
-		if a[m].num < num {
-			s = m
-		} else {
-			e = m
+		case req := <-d:
+			compress := cfgs.Load().logCfg(req.name).keep.compressNow
+			req.resp <- delete_(req, compress, getLogR, reg, dbloc)
+
+		case req := <-m:
+			req.resp <- move_(req, getLogR, reg, dbloc)
+
+		case <-ticker.C:
+			idle := cfgs.Load().idle
+			if idle > 0 {
+				closeIdle(idle, reg)
+			}
 		}
 	}
-	return uint32(len(a))
 }
 
 /*    way/
- * validate that message header is correct then,
- * read message data from disk
+ * take each log that hasn't been handed out for the idle time out of
+ * the registry and ask it to close (which it will do if it hasn't been
+ * used for that time either) - putting it back if it doesn't
+ *
+ *    understand/
+ * as we haven't handed the log out for the idle time no one should be
+ * holding on to it - but if they are they will find it closed rather
+ * than waiting forever (see send). While it is out of the registry,
+ * anyone looking for it has to wait for us in logsGo.
  */
-func readMsg(mo msgOff, f *os.File) (*msg, error) {
-
-	msg, err := readRecInfo(mo.offset, f)
-	if err != nil {
-		return nil, err
-	}
-
-	if msg.num == 0 {
-		m := fmt.Sprintf("No message data found at offset %d for msg %d", mo.offset, mo.num)
-		return nil, errors.New(m)
+func closeIdle(idle time.Duration, reg *registry) {
+	logRs, _ := reg.all()
+	for _, logR := range logRs {
+		closeLogR(logR.name, idle, idle, reg)
 	}
+}
 
-	if mo.num != msg.num {
-		return nil, errors.New("Message number on disk incorrect")
+/*    way/
+ * close the log if it hasn't been handed out (or used) for the given
+ * times
+ */
+func closeLogR(name string, handed, used time.Duration, reg *registry) {
+	logR := reg.find_(name)
+	if logR == nil || !reg.takeIdle(name, handed) {
+		return
 	}
-
-	data := make([]byte, msg.sz)
-	_, err = f.ReadAt(data, msg.offset+int64(msg.start))
-	if err != nil {
-		return nil, err
+	c := make(chan stopReqResp)
+	logR.stop <- stopReq{used, c}
+	resp := <-c
+	if resp.stopped {
+		reg.unload(name, logMeta{resp.lastmsg, time.Now()})
+	} else {
+		reg.add(logR)
 	}
-	msg.data = data
-
-	return &msg, nil
 }
 
 /*    way/
- * read in the message then append it to the end of the file with the
- * correct record header (KAF|num|sz)
+ * delete the log - taking it out of the registry so no one else can
+ * find it, archiving all it's messages first (if asked), closing it and
+ * then removing it's files. We remove the log file first so, if we
+ * stop part way, the log is already gone.
+ *
+ *    understand/
+ * anyone still holding on to the log finds it closed (see send) and
+ * any archives of the log are kept. Deleting a log that was renamed
+ * just forgets it was renamed (freeing up the name). Either way, names
+ * that were renamed to it are forgotten too as they now lead nowhere.
  */
-func put_(data []byte, msglog *msgLog) putReqResp {
-	msglog.putCount++
+func delete_(req deleteReq, compress bool, getLogR func(string, bool) (*logRoutine, error), reg *registry, dbloc string) deleteReqResp {
+	resp := deleteLog(req, compress, getLogR, reg, dbloc)
+	if resp.err == nil || resp.err == errNoLog {
+		if err := forgetRenamesTo(req.name, reg, dbloc); err != nil && resp.err == nil {
+			resp.err = err
+		}
+	}
+	return resp
+}
 
-	inf, err := msglog.f.Stat()
+func deleteLog(req deleteReq, compress bool, getLogR func(string, bool) (*logRoutine, error), reg *registry, dbloc string) deleteReqResp {
+	if _, ok := reg.renamedTo(req.name); ok {
+		return deleteReqResp{0, forgetRename(req.name, reg, dbloc)}
+	}
+	logR, err := getLogR(req.name, false)
 	if err != nil {
-		msglog.errCount++
-		return putReqResp{0, err}
+		return deleteReqResp{0, err}
 	}
-	if msglog.size != inf.Size() {
-		if !fileExists(msglog.loc) {
-			createLogFile(msglog.loc, 0)
+	if logR == nil {
+		return deleteReqResp{0, errNoLog}
+	}
+	reg.remove(req.name)
+
+	var archived uint64
+	if req.archive {
+		stats, err := peekStats(logR)
+		if err == nil && stats.lastmsg > stats.start {
+			c := make(chan achReqResp)
+			logR.ach <- archiveReq{upto: stats.lastmsg, compress: compress, resp: c}
+			resp := <-c
+			archived, err = resp.upto, resp.err
 		}
-		if err := loadLogFile(msglog); err != nil {
-			return putReqResp{0, err}
+		if err != nil {
+			reg.add(logR)
+			return deleteReqResp{archived, err}
 		}
 	}
-	off := inf.Size()
-	num := msglog.lastmsg + 1
 
-	hdr := fmt.Sprintf("%s%d|%d%s", RecHeaderPfx, num, len(data), RecHeaderSfx)
-	hdr_ := []byte(hdr)
-	if _, err := msglog.f.WriteAt(hdr_, off); err != nil {
-		msglog.errCount++
-		return putReqResp{0, err}
+	c := make(chan stopReqResp)
+	logR.stop <- stopReq{0, c}
+	if !(<-c).stopped {
+		reg.add(logR)
+		return deleteReqResp{archived, errLogBusy}
 	}
-	start := uint32(len(hdr_))
 
-	if _, err := msglog.f.WriteAt(data, off+int64(start)); err != nil {
-		msglog.errCount++
-		return putReqResp{0, err}
+	msglog := &msgLog{name: req.name, loc: filepath.Join(dbloc, req.name)}
+	locs, err := segmentLocs(msglog)
+	if err != nil {
+		return deleteReqResp{archived, err}
 	}
-
-	msglog.msgOs = append(msglog.msgOs, msgOff{num, off})
-	msglog.lastmsg = num
-	msglog.size += int64(len(data)) + int64(start)
-
-	return putReqResp{num, nil}
+	for _, loc := range append([]string{msglog.loc}, locs...) {
+		os.Remove(idxLoc(loc))
+		if err := os.Remove(loc); err != nil && !os.IsNotExist(err) {
+			return deleteReqResp{archived, err}
+		}
+	}
+	return deleteReqResp{archived, nil}
 }
 
-/*    outcome/
- * clear any existing data, (re)-open the log file, read in the header
- * and message offsets and repopulate the msglog
+/*    way/
+ * rename (or copy) the log - taking it out of the registry and closing
+ * it so it's files don't change under us, then moving (or copying)
+ * them to the new name. When renaming we first note that the log has
+ * been renamed so requests for it go to the new name (which wait for
+ * us here until we are done).
+ *
+ *    understand/
+ * anyone still holding on to the log finds it closed (see send) and,
+ * when they retry, find it renamed or (for a copy) open it again
  */
-func loadLogFile(msglog *msgLog) error {
-	clearMsgLog(msglog)
-
-	f, err := os.OpenFile(msglog.loc, os.O_RDWR, 0644)
+func move_(req moveReq, getLogR func(string, bool) (*logRoutine, error), reg *registry, dbloc string) error {
+	logR, err := getLogR(req.name, false)
 	if err != nil {
 		return err
 	}
-	inf, err := f.Stat()
+	if logR == nil {
+		return errNoLog
+	}
+	from := &msgLog{name: req.name, loc: filepath.Join(dbloc, req.name)}
+	to := &msgLog{name: req.to, loc: filepath.Join(dbloc, req.to)}
+	locs, err := segmentLocs(to)
 	if err != nil {
 		return err
 	}
+	if reg.find(req.to) != nil || fileExists(to.loc) || len(locs) > 0 {
+		return errLogExists
+	}
 
-	msglog.f = f
-	msglog.size = inf.Size()
+	reg.remove(req.name)
+	c := make(chan stopReqResp)
+	logR.stop <- stopReq{0, c}
+	resp := <-c
+	if !resp.stopped {
+		reg.add(logR)
+		return errLogBusy
+	}
+	meta := logMeta{resp.lastmsg, time.Now()}
+
+	if req.copy {
+		reg.unload(req.name, meta)
+		if err := moveLogFiles(from, to, true); err != nil {
+			return err
+		}
+	} else {
+		if err := saveRename(req.name, req.to, reg, dbloc); err != nil {
+			reg.unload(req.name, meta)
+			return err
+		}
+		if err := moveLogFiles(from, to, false); err != nil {
+			forgetRename(req.name, reg, dbloc)
+			reg.unload(req.name, meta)
+			return err
+		}
+	}
+	if _, ok := reg.renamedTo(req.to); ok {
+		forgetRename(req.to, reg, dbloc)
+	}
+	return nil
+}
 
-	hdrEnd, err := loadDBHeader(msglog)
+/*    way/
+ * move (or copy) the log's files to the new name - sealed segments
+ * first and the log file last so the new log only appears when it is
+ * complete - undoing what we have done if anything fails. Renaming the
+ * log renames it's archives too. Sealed segments never change so a
+ * copy can share them (by linking).
+ */
+func moveLogFiles(from, to *msgLog, copy bool) error {
+	dir := filepath.Dir(from.loc)
+	locs, err := segmentLocs(from)
 	if err != nil {
 		return err
 	}
-
-	if err := loadMsgOffsets(hdrEnd, msglog); err != nil {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	type mv struct {
+		src, dst string
+		link     bool
+	}
+	var mvs []mv
+	toLoc := func(loc string) string {
+		return filepath.Join(dir, "--"+to.name+strings.TrimPrefix(filepath.Base(loc), "--"+from.name))
+	}
+	for _, loc := range locs {
+		mvs = append(mvs, mv{loc, toLoc(loc), true}, mv{idxLoc(loc), idxLoc(toLoc(loc)), false})
+	}
+	for _, f := range files {
+		name, _, ok := parseArchiveName(f.Name())
+		if !copy && ok && name == from.name {
+			loc := filepath.Join(dir, f.Name())
+			mvs = append(mvs, mv{loc, toLoc(loc), false})
+		}
+	}
+	mvs = append(mvs, mv{idxLoc(from.loc), idxLoc(to.loc), false}, mv{from.loc, to.loc, false})
 
-func clearMsgLog(msglog *msgLog) {
-	if msglog.f != nil {
-		msglog.f.Close()
+	var done []mv
+	for _, m := range mvs {
+		if !fileExists(m.src) {
+			continue
+		}
+		var err error
+		switch {
+		case fileExists(m.dst):
+			err = errLogExists
+		case !copy:
+			err = os.Rename(m.src, m.dst)
+		case m.link:
+			if err = os.Link(m.src, m.dst); err != nil {
+				err = copyFile(m.src, m.dst)
+			}
+		default:
+			err = copyFile(m.src, m.dst)
+		}
+		if err != nil {
+			for i := len(done) - 1; i >= 0; i-- {
+				if copy {
+					os.Remove(done[i].dst)
+				} else {
+					os.Rename(done[i].dst, done[i].src)
+				}
+			}
+			return err
+		}
+		done = append(done, m)
 	}
-	msglog.f = nil
-	msglog.size = 0
-	msglog.lastmsg = 0
-	msglog.msgOs = nil
+	return nil
 }
 
-/*    outcome/
- * validate the first part of the header (fixed part), then read in the
- * lastmsg number
+/*    understand/
+ * we remember a log has been renamed in a hidden file named after it
+ * (holding the new name) so we can tell clients asking for it even
+ * after we restart
  */
-func loadDBHeader(msglog *msgLog) (int64, error) {
-	const BIGENOUGH = 32
-	hdr := make([]byte, BIGENOUGH)
+func renamedLoc(dbloc, name string) string {
+	return filepath.Join(dbloc, "."+name+".renamed")
+}
 
-	n, err := msglog.f.ReadAt(hdr, 0)
-	if err != nil && err != io.EOF {
-		return 0, err
+func loadRenames(dbloc string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dbloc)
+	if err != nil {
+		return nil, err
+	}
+	renamed := map[string]string{}
+	for _, f := range files {
+		fname := f.Name()
+		if f.IsDir() || !strings.HasPrefix(fname, ".") || !strings.HasSuffix(fname, ".renamed") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dbloc, fname))
+		if err != nil {
+			return nil, err
+		}
+		renamed[strings.TrimSuffix(fname[1:], ".renamed")] = strings.TrimSpace(string(data))
 	}
+	return renamed, nil
+}
 
-	l := len(DBHeader)
+func saveRename(name, to string, reg *registry, dbloc string) error {
+	if err := ioutil.WriteFile(renamedLoc(dbloc, name), []byte(to), 0644); err != nil {
+		return err
+	}
+	reg.setRenamed(name, to)
+	return nil
+}
 
-	if bytes.Compare([]byte(DBHeader), hdr[:l]) != 0 {
-		return 0, errors.New("invalid db header")
+func forgetRename(name string, reg *registry, dbloc string) error {
+	reg.setRenamed(name, "")
+	err := os.Remove(renamedLoc(dbloc, name))
+	if os.IsNotExist(err) {
+		return nil
 	}
+	return err
+}
 
-	e := l
-	for e < n {
-		e++
-		if e == n || hdr[e] == '\n' {
-			break
+/*    way/
+ * forget every name renamed to the given name - and those renamed to
+ * them in turn
+ */
+func forgetRenamesTo(to string, reg *registry, dbloc string) error {
+	for _, name := range reg.renamedFrom(to) {
+		if err := forgetRename(name, reg, dbloc); err != nil {
+			return err
+		}
+		if err := forgetRenamesTo(name, reg, dbloc); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	lastmsg, err := strconv.ParseUint(string(hdr[l:e]), 10, 32)
-	if err != nil {
-		m := fmt.Sprintf("bad last message number: %s", hdr[l:e])
-		return 0, errors.New(m)
+/*    way/
+ * find the open log, noting that it has been handed out
+ */
+func (reg *registry) find(name string) *logRoutine {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	logR := reg.logRs[name]
+	if logR != nil {
+		logR.handed.Store(time.Now().UnixNano())
 	}
+	return logR
+}
 
-	msglog.lastmsg = uint32(lastmsg)
+func (reg *registry) add(logR *logRoutine) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.logRs[logR.name] = logR
+	delete(reg.closed, logR.name)
+}
 
-	return int64(e), nil
+/*    way/
+ * find the open log without handing it out
+ */
+func (reg *registry) find_(name string) *logRoutine {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.logRs[name]
 }
 
 /*    way/
- * Step through the file, loading message offsets
+ * take the log out of the registry if it hasn't been handed out for the
+ * given time
  */
-func loadMsgOffsets(start int64, msglog *msgLog) error {
-	offset := start
+func (reg *registry) takeIdle(name string, idle time.Duration) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	logR := reg.logRs[name]
+	if logR == nil || time.Since(time.Unix(0, logR.handed.Load())) < idle {
+		return false
+	}
+	delete(reg.logRs, name)
+	return true
+}
 
-	var msgOs []msgOff
-	for offset < msglog.size {
-		msg, err := readRecInfo(offset, msglog.f)
-		if err != nil {
-			return err
-		}
-		if msg.num > 0 {
-			msgOs = append(msgOs, msgOff{msg.num, msg.offset})
-			if msg.num <= msglog.lastmsg {
-				m := fmt.Sprintf("message number did not increase (%d !< %d)", msglog.lastmsg, msg.num)
-				return errors.New(m)
-			}
-			msglog.lastmsg = msg.num
-		}
-		if msg.sz+msg.start != 0 {
-			offset = msg.offset + int64(msg.start+msg.sz)
+func (reg *registry) remove(name string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.logRs, name)
+	delete(reg.closed, name)
+}
+
+func (reg *registry) renamedTo(name string) (string, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	to, ok := reg.renamed[name]
+	return to, ok
+}
+
+func (reg *registry) renamedFrom(to string) []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	var names []string
+	for name, to_ := range reg.renamed {
+		if to_ == to {
+			names = append(names, name)
 		}
 	}
+	return names
+}
 
-	msglog.msgOs = msgOs
+func (reg *registry) setRenamed(name, to string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if len(to) == 0 {
+		delete(reg.renamed, name)
+	} else {
+		reg.renamed[name] = to
+	}
+}
 
-	return nil
+func (reg *registry) unload(name string, meta logMeta) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.logRs, name)
+	reg.closed[name] = meta
 }
 
 /*    way/
- * read a chunk of data from the offset that should be big enough to
- * hold the header (marked off by the newline) and return the message
- * info from the header.
+ * return the open logs and what we know of closed logs
+ */
+func (reg *registry) all() ([]*logRoutine, map[string]logMeta) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	var logRs []*logRoutine
+	for _, logR := range reg.logRs {
+		logRs = append(logRs, logR)
+	}
+	closed := map[string]logMeta{}
+	for name, meta := range reg.closed {
+		closed[name] = meta
+	}
+	return logRs, closed
+}
+
+/*    way/
+ * send a request to the log's goroutine - failing if the log has been
+ * closed
+ */
+func send[T any](logR *logRoutine, c chan T, req T) error {
+	select {
+	case c <- req:
+		return nil
+	case <-logR.done:
+		return errLogClosed
+	}
+}
+
+/*    understand/
+ * a transaction adds messages to several logs - either all of them or
+ * none of them. So that other transactions can't get in the way, we run
+ * one at a time (see txnsGo).
+ *
+ *    way/
+ * ask each log (in name order) to prepare for it's messages - checking
+ * they can be added and then waiting for us. If any log can't, we abort
+ * them all. Otherwise we write an intent record with all the messages
+ * to the _txn log (so we can finish the transaction if we crash or a
+ * log fails), commit every log, and then mark the intent done.
+ * When recovering, the intent is already written and the logs skip any
+ * messages they already have. If any log fails to commit, the intent
+ * is left pending (without a done record) to be finished later.
  *
  *    understand/
- * message header is of the format:
- *    KAF|<string number>|<string size>\n
+ * a log can be renamed or deleted while it's transaction is pending.
+ * When recovering we follow the log to it's new name and drop the
+ * messages of logs that no longer exist - never creating them again
+ * (which would start them from message 1).
  */
-func readRecInfo(off int64, f *os.File) (msg, error) {
-	const BIGENOUGH = 32
-	hdr := make([]byte, BIGENOUGH)
-
-	pos := struct {
-		curr          int
-		headerStart   int
-		firstDivider  int
-		secondDivider int
-		headerEnd     int
-	}{0, -1, -1, -1, -1}
+func txn_(req txnReq, logsR logsRoutine) txnReqResp {
+	recovering := req.id != 0
+	var names []string
+	byLog := map[string][]int{}
+	for i, p := range req.puts {
+		name := p.log
+		if recovering {
+			name = renamedLog(name, logsR.reg)
+		}
+		if byLog[name] == nil {
+			names = append(names, name)
+		}
+		byLog[name] = append(byLog[name], i)
+	}
+	sort.Strings(names)
+
+	var prepared []chan commitReq
+	abort := func() {
+		for _, next := range prepared {
+			c := make(chan txnPutsResp)
+			next <- commitReq{commit: false, resp: c}
+			<-c
+		}
+	}
 
-	n, err := f.ReadAt(hdr, off)
-	if err != nil && err != io.EOF {
-		return msg{}, err
+	var committing []string
+	for _, name := range names {
+		logR, err := getLog(name, logsR, !recovering)
+		if err == nil && logR == nil && recovering {
+			if to, ok := logsR.reg.renamedTo(name); ok {
+				err = renamedErr{to}
+			} else {
+				log.Println("transaction", req.id, name+": log no longer exists - dropping it's messages")
+				continue
+			}
+		}
+		if err == nil && logR == nil {
+			err = errNoLog
+		}
+		if err != nil {
+			abort()
+			return txnReqResp{err: fmt.Errorf("%s: %w", name, err)}
+		}
+		var puts []txnPut
+		for _, i := range byLog[name] {
+			puts = append(puts, req.puts[i])
+		}
+		pr := prepareReq{
+			puts:  puts,
+			quota: req.cfgs[name].quota,
+			roll:  req.cfgs[name].roll,
+			resp:  make(chan error),
+			next:  make(chan commitReq),
+		}
+		err = send(logR, logR.txn, pr)
+		if err == nil {
+			err = <-pr.resp
+		}
+		if err != nil {
+			abort()
+			return txnReqResp{err: fmt.Errorf("%s: %w", name, err)}
+		}
+		prepared = append(prepared, pr.next)
+		committing = append(committing, name)
 	}
 
-	if n == 0 {
-		m := fmt.Sprintf("read at offset %d failed", off)
-		return msg{}, errors.New(m)
+	txnR, err := getLog(TxnLog, logsR, true)
+	if err != nil {
+		abort()
+		return txnReqResp{err: err}
 	}
 
-	for ; pos.curr < n; pos.curr++ {
-		if hdr[pos.curr] != '\n' {
-			break
+	id, at := req.id, req.at
+	if id == 0 {
+		at = time.Now().UnixMilli()
+		c := make(chan putReqResp)
+		err := send(txnR, txnR.put, putReq{data: encodeTxn(req.puts), resp: c})
+		if err == nil {
+			resp := <-c
+			err, id = resp.err, resp.num
+		}
+		if err != nil {
+			abort()
+			return txnReqResp{err: err}
 		}
 	}
 
-	if pos.curr == 0 {
-		return msg{}, errors.New("invalid record header start")
+	nums := make([]uint64, len(req.puts))
+	var txnErr error
+	for i, name := range committing {
+		c := make(chan txnPutsResp)
+		prepared[i] <- commitReq{
+			commit:  true,
+			id:      id,
+			at:      at,
+			recover: recovering,
+			resp:    c,
+		}
+		resp := <-c
+		if resp.err != nil && txnErr == nil {
+			txnErr = fmt.Errorf("%s: %w", name, resp.err)
+		}
+		for j, num := range resp.nums {
+			nums[byLog[name][j]] = num
+		}
+	}
+	if txnErr != nil {
+		return txnReqResp{nums, id, at, fmt.Errorf("%w (%s)", errTxnPending, txnErr)}
 	}
 
-	if pos.curr == n {
-		return msg{
-			offset: off,
-			start:  uint32(n),
-			num:    0,
-			sz:     0,
-			data:   nil,
-		}, nil
+	c := make(chan putReqResp)
+	done := fmt.Sprintf("%s%d", TxnDonePfx, id)
+	if err := send(txnR, txnR.put, putReq{data: []byte(done), resp: c}); err != nil {
+		return txnReqResp{nums, id, at, err}
 	}
+	resp := <-c
 
-	pos.headerStart = pos.curr - 1
+	return txnReqResp{nums, id, at, resp.err}
+}
 
-	for ; pos.curr < n; pos.curr++ {
-		if hdr[pos.curr] == '|' {
-			if pos.firstDivider == -1 {
-				pos.firstDivider = pos.curr
-			} else if pos.secondDivider == -1 {
-				pos.secondDivider = pos.curr
-			} else {
-				return msg{}, errors.New("invalid record header: extra '|' found")
-			}
-		}
-		if hdr[pos.curr] == []byte(RecHeaderSfx)[0] {
-			pos.headerEnd = pos.curr
+/*    way/
+ * follow the log's renames (each of which may have been renamed in
+ * turn) to the name it has now
+ */
+func renamedLog(name string, reg *registry) string {
+	seen := map[string]bool{}
+	for !seen[name] {
+		seen[name] = true
+		to, ok := reg.renamedTo(name)
+		if !ok {
 			break
 		}
+		name = to
 	}
+	return name
+}
 
-	rechdr := hdr[pos.headerStart : pos.firstDivider+1]
-	if bytes.Compare(rechdr, []byte(RecHeaderPfx)) != 0 {
-		return msg{}, errors.New("invalid record header prefix")
-	}
+/*    way/
+ * run transactions one at a time. If one is left pending (a log failed
+ * to commit) try finishing it straight away and, if that doesn't work,
+ * keep trying every minute till it is done.
+ */
+func txnsGo(t chan txnReq, pending []txnReq, logsR logsRoutine) {
+	ticker := time.NewTicker(time.Minute)
+	for {
+		select {
+		case req := <-t:
+			resp := txn_(req, logsR)
+			if errors.Is(resp.err, errTxnPending) {
+				id, at := resp.id, resp.at
+				if r := txn_(txnReq{puts: req.puts, id: id, at: at}, logsR); r.err == nil {
+					resp = r
+				} else {
+					pending = append(pending, txnReq{puts: req.puts, id: id, at: at})
+				}
+			}
+			req.resp <- resp
 
-	if pos.firstDivider == -1 {
-		return msg{}, errors.New("invalid record header: no number")
+		case <-ticker.C:
+			pending = finishTxns(pending, logsR)
+		}
 	}
+}
 
-	if pos.secondDivider == -1 {
-		return msg{}, errors.New("invalid record header: no size")
+/*    way/
+ * try to finish each pending transaction - returning those still
+ * pending
+ */
+func finishTxns(pending []txnReq, logsR logsRoutine) []txnReq {
+	var still []txnReq
+	for _, req := range pending {
+		log.Println("Finishing transaction", req.id)
+		if resp := txn_(req, logsR); resp.err != nil {
+			log.Println("transaction", req.id, resp.err)
+			still = append(still, req)
+		}
 	}
+	return still
+}
 
-	if pos.headerEnd == -1 {
-		return msg{}, errors.New("invalid record header: not terminated correctly")
+/*    understand/
+ * transaction intents are recorded in a human-friendly format similar
+ * to the message log itself:
+ *    KAF_TXN|v1|<num messages>
+ *    KAF_PUT|<log>|<size>|<meta>\n
+ *    <message data>
+ *    ...
+ * and marked done with:
+ *    KAF_TXN_DONE|<intent message number>
+ */
+func encodeTxn(puts []txnPut) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s|%d", TxnHeaderPfx, len(puts))
+	for _, p := range puts {
+		fmt.Fprintf(&b, "\n%s%s|%d", TxnPutPfx, p.log, len(p.data))
+		if m := encodeMeta(p.meta); len(m) > 0 {
+			b.WriteString("|" + m)
+		}
+		b.WriteString("\n")
+		b.Write(p.data)
 	}
+	return b.Bytes()
+}
 
-	v := string(hdr[pos.firstDivider+1 : pos.secondDivider])
-	num, err := strconv.ParseUint(v, 10, 32)
-	if err != nil {
-		return msg{}, errors.New("invalid record header message number")
+/*    way/
+ * check the transaction header then walk through each put, reading in
+ * it's header line and then it's data
+ */
+func decodeTxn(b []byte) ([]txnPut, error) {
+	end := bytes.IndexByte(b, '\n')
+	if end == -1 {
+		end = len(b)
+	}
+	hdr, rest := b[:end], b[end:]
+	if !bytes.HasPrefix(hdr, []byte(TxnHeaderPfx+"|")) {
+		return nil, errors.New("invalid transaction header")
 	}
-	v = string(hdr[pos.secondDivider+1 : pos.headerEnd])
-	sz, err := strconv.ParseUint(v, 10, 32)
+	n, err := strconv.ParseUint(string(hdr[len(TxnHeaderPfx)+1:]), 10, 64)
 	if err != nil {
-		return msg{}, errors.New("invalid record header message size")
+		return nil, errors.New("invalid transaction header count")
 	}
 
-	return msg{
-		offset: off,
-		start:  uint32(pos.headerEnd + 1),
-		num:    uint32(num),
-		sz:     uint32(sz),
-		data:   nil,
-	}, nil
+	var puts []txnPut
+	for len(rest) > 0 {
+		if !bytes.HasPrefix(rest, []byte("\n"+TxnPutPfx)) {
+			return nil, errors.New("invalid transaction put header")
+		}
+		line, data, ok := bytes.Cut(rest[1:], []byte("\n"))
+		if !ok {
+			return nil, errors.New("transaction put header not terminated")
+		}
+		f := strings.Split(string(line[len(TxnPutPfx):]), "|")
+		if len(f) < 2 || len(f) > 3 {
+			return nil, errors.New("invalid transaction put header")
+		}
+		sz, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil || sz > uint64(len(data)) {
+			return nil, errors.New("invalid transaction put size")
+		}
+		p := txnPut{log: f[0], data: data[:sz]}
+		if len(f) == 3 {
+			if p.meta, err = decodeMeta(f[2]); err != nil {
+				return nil, err
+			}
+		}
+		puts = append(puts, p)
+		rest = data[sz:]
+	}
 
+	if uint64(len(puts)) != n {
+		return nil, errors.New("transaction count does not match")
+	}
+	return puts, nil
 }
 
 /*    way/
- * setup the server with the correct configuration and handlers and
- * start it up
+ * find every transaction intent in the _txn log that hasn't been marked
+ * done (as we crashed or a log failed before we could finish it)
  */
-func startServer(cfg *config, logsR logsRoutine) {
-
-	s := &http.Server{
-		Addr:           cfg.addr,
-		Handler:        requestHandlers(cfg, logsR),
-		ReadTimeout:    time.Second,
-		WriteTimeout:   time.Second,
-		MaxHeaderBytes: 4096,
+func pendingTxns(logsR logsRoutine) ([]txnReq, error) {
+	logR, err := getLog(TxnLog, logsR, false)
+	if err != nil || logR == nil {
+		return nil, err
 	}
 
-	log.Println("Starting server on", cfg.addr, "writing to", cfg.dbloc)
-	log.Fatal(s.ListenAndServe())
-}
+	intents := map[uint64]txnReq{}
+	c := make(chan getReqResp)
+	var num uint64 = 1
+	for {
+		if err := send(logR, logR.get, getReq{num: num, resp: c}); err != nil {
+			return nil, err
+		}
+		resp := <-c
+		if resp.err != nil {
+			return nil, resp.err
+		}
+		if len(resp.msgs) == 0 {
+			break
+		}
+		for _, m := range resp.msgs {
+			num = m.num + 1
+			switch {
+			case bytes.HasPrefix(m.data, []byte(TxnHeaderPfx+"|")):
+				puts, err := decodeTxn(m.data)
+				if err != nil {
+					return nil, fmt.Errorf("%s: message %d: %s", TxnLog, m.num, err)
+				}
+				intents[m.num] = txnReq{puts: puts, id: m.num, at: m.meta.at}
+			case bytes.HasPrefix(m.data, []byte(TxnDonePfx)):
+				id, err := strconv.ParseUint(string(m.data[len(TxnDonePfx):]), 10, 64)
+				if err == nil {
+					delete(intents, id)
+				}
+			}
+		}
+	}
+
+	var pending []txnReq
+	for _, req := range intents {
+		pending = append(pending, req)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].id < pending[j].id
+	})
+	return pending, nil
+}
+
+/*    way/
+ * read every committed offset saved in the _consumers log - later
+ * commits replacing earlier ones
+ */
+func loadOffsets(logsR logsRoutine) (map[string]map[string]uint64, error) {
+	offsets := map[string]map[string]uint64{}
+
+	logR, err := getLog(ConsumerLog, logsR, false)
+	if err != nil || logR == nil {
+		return offsets, err
+	}
+
+	c := make(chan getReqResp)
+	var num uint64 = 1
+	for {
+		if err := send(logR, logR.get, getReq{num: num, resp: c}); err != nil {
+			return nil, err
+		}
+		resp := <-c
+		if resp.err != nil {
+			return nil, resp.err
+		}
+		if len(resp.msgs) == 0 {
+			return offsets, nil
+		}
+		for _, m := range resp.msgs {
+			num = m.num + 1
+			if len(m.data) == 0 {
+				dropOffset(offsets, m.meta.key)
+				continue
+			}
+			var rec offsetRec
+			if err := json.Unmarshal(m.data, &rec); err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: message %d: %s", ConsumerLog, m.num, err.Error()))
+			}
+			setOffset(offsets, rec)
+		}
+	}
+}
+
+func setOffset(offsets map[string]map[string]uint64, rec offsetRec) {
+	if offsets[rec.Log] == nil {
+		offsets[rec.Log] = map[string]uint64{}
+	}
+	offsets[rec.Log][rec.Consumer] = rec.Upto
+}
+
+/*    understand/
+ * log names can't contain a "/" so the key of a tombstone splits at
+ * the first one into the log and consumer
+ */
+func dropOffset(offsets map[string]map[string]uint64, key string) {
+	name, consumer, ok := strings.Cut(key, "/")
+	if !ok {
+		return
+	}
+	delete(offsets[name], consumer)
+	if len(offsets[name]) == 0 {
+		delete(offsets, name)
+	}
+}
+
+/*    way/
+ * manage the offsets consumers have committed - saving each commit (or
+ * tombstone of a dropped offset) to the _consumers log (keyed by log and
+ * consumer so it can be compacted) before responding. Moved offsets are
+ * committed for the new log before they are dropped.
+ */
+func consumersGo(offsets map[string]map[string]uint64, o chan offsetReq, logsR logsRoutine) {
+	for req := range o {
+		switch {
+		case req.drop:
+			var err error
+			for consumer, upto := range offsets[req.log] {
+				if len(req.consumer) > 0 && consumer != req.consumer {
+					continue
+				}
+				key := req.log + "/" + consumer
+				if !req.saved && len(req.to) > 0 {
+					rec := offsetRec{req.to, consumer, upto}
+					if err = saveOffset(rec, logsR); err != nil {
+						break
+					}
+					setOffset(offsets, rec)
+				}
+				if !req.saved {
+					if err = saveOffsetRec(key, nil, logsR); err != nil {
+						break
+					}
+				}
+				dropOffset(offsets, key)
+			}
+			req.resp <- offsetReqResp{ok: err == nil, err: err}
+
+		case req.commit:
+			rec := offsetRec{req.log, req.consumer, req.upto}
+			err := saveOffset(rec, logsR)
+			if err == nil {
+				setOffset(offsets, rec)
+			}
+			req.resp <- offsetReqResp{upto: req.upto, ok: err == nil, err: err}
+
+		case req.saved:
+			setOffset(offsets, offsetRec{req.log, req.consumer, req.upto})
+			req.resp <- offsetReqResp{upto: req.upto, ok: true}
+
+		case req.all:
+			all := map[string]map[string]uint64{}
+			for name, consumers := range offsets {
+				all[name] = map[string]uint64{}
+				for consumer, upto := range consumers {
+					all[name][consumer] = upto
+				}
+			}
+			req.resp <- offsetReqResp{offsets: all, ok: true}
+
+		default:
+			upto, ok := offsets[req.log][req.consumer]
+			req.resp <- offsetReqResp{upto: upto, ok: ok}
+		}
+	}
+}
+
+func saveOffset(rec offsetRec, logsR logsRoutine) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return saveOffsetRec(rec.Log+"/"+rec.Consumer, data, logsR)
+}
+
+func saveOffsetRec(key string, data []byte, logsR logsRoutine) error {
+	logR, err := getLog(ConsumerLog, logsR, true)
+	if err != nil {
+		return err
+	}
+	c := make(chan putReqResp)
+	err = send(logR, logR.put, putReq{
+		data: data,
+		meta: recMeta{key: key},
+		resp: c,
+	})
+	if err != nil {
+		return err
+	}
+	return (<-c).err
+}
+
+/*    way/
+ * manage the messages leased to each group of workers - starting a
+ * group from the offset it last committed
+ */
+func leasesGo(l chan leaseReq, logsR logsRoutine) {
+	groups := map[string]*leaseGroup{}
+
+	for req := range l {
+		if len(req.log) > 0 {
+			for k, g := range groups {
+				if group, ok := strings.CutPrefix(k, req.log+"/"); ok {
+					delete(groups, k)
+					if len(req.to) > 0 {
+						groups[req.to+"/"+group] = g
+					}
+				}
+			}
+			req.resp <- leaseReqResp{}
+			continue
+		}
+
+		k := req.logR.name + "/" + req.group
+		g := groups[k]
+		if g == nil {
+			floor, _ := getOffset(req.logR.name, GroupPfx+req.group, logsR)
+			g = &leaseGroup{
+				next:   floor + 1,
+				floor:  floor,
+				leases: map[uint64]*leased{},
+			}
+			groups[k] = g
+		}
+
+		var resp leaseReqResp
+		if req.ack {
+			resp = ack_(req, g)
+		} else {
+			resp = lease_(req, g, logsR)
+		}
+		if err := commitFloor(req, g, logsR); err != nil && resp.err == nil {
+			resp.err = err
+		}
+		req.resp <- resp
+	}
+}
+
+/*    way/
+ * hand out the oldest message whose lease has expired - moving it to the
+ * dead letter log instead if it has been tried too many times - or else
+ * the next message the group hasn't seen
+ */
+func lease_(req leaseReq, g *leaseGroup, logsR logsRoutine) leaseReqResp {
+	now := time.Now()
+	timeout := req.leasing.timeout
+	if timeout == 0 {
+		timeout = LeaseTimeout
+	}
+	retries := req.leasing.retries
+	if retries == 0 {
+		retries = LeaseRetries
+	}
+
+	var expired []uint64
+	for num, l := range g.leases {
+		if now.After(l.until) {
+			expired = append(expired, num)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+
+	for _, num := range expired {
+		l := g.leases[num]
+		m, err := leaseMsg(req.logR, num)
+		if err != nil {
+			return leaseReqResp{err: err}
+		}
+		if m == nil || m.num != num {
+			delete(g.leases, num)
+			continue
+		}
+		if l.tries > retries {
+			if err := deadLetter(req, m, l.tries, logsR); err != nil {
+				return leaseReqResp{err: err}
+			}
+			delete(g.leases, num)
+			continue
+		}
+		l.id = leaseID()
+		l.until = now.Add(timeout)
+		l.tries++
+		return leaseReqResp{m, l.id, l.until, l.tries, nil}
+	}
+
+	m, err := leaseMsg(req.logR, g.next)
+	if err != nil || m == nil {
+		return leaseReqResp{err: err}
+	}
+	l := &leased{leaseID(), now.Add(timeout), 1}
+	g.leases[m.num] = l
+	g.next = m.num + 1
+	return leaseReqResp{m, l.id, l.until, l.tries, nil}
+}
+
+/*    way/
+ * mark the leased message done - as long as it is still leased with the
+ * lease the worker was given
+ */
+func ack_(req leaseReq, g *leaseGroup) leaseReqResp {
+	l := g.leases[req.num]
+	if l == nil || l.id != req.id {
+		return leaseReqResp{err: errNotLeased}
+	}
+	delete(g.leases, req.num)
+	return leaseReqResp{id: req.id}
+}
+
+/*    way/
+ * the group is done upto the oldest message still leased (or all the
+ * messages it has seen). When that moves we commit it as the group's
+ * offset (as the consumer group:<name> - a name consumers can't commit
+ * to) so a restarted kaf continues from there.
+ */
+func commitFloor(req leaseReq, g *leaseGroup, logsR logsRoutine) error {
+	floor := g.next - 1
+	for num := range g.leases {
+		if num-1 < floor {
+			floor = num - 1
+		}
+	}
+	if floor == g.floor {
+		return nil
+	}
+	if err := commitOffset(req.logR.name, GroupPfx+req.group, floor, logsR); err != nil {
+		return err
+	}
+	g.floor = floor
+	return nil
+}
+
+/*    way/
+ * get the message at (or, if missing, after) the given number
+ */
+func leaseMsg(logR *logRoutine, num uint64) (*msg, error) {
+	c := make(chan getReqResp)
+	if err := send(logR, logR.get, getReq{num: num, resp: c}); err != nil {
+		return nil, err
+	}
+	resp := <-c
+	if resp.err != nil || len(resp.msgs) == 0 {
+		return nil, resp.err
+	}
+	return resp.msgs[0], nil
+}
+
+/*    way/
+ * put the message into the dead letter log (keeping it's key and
+ * metadata and adding where it came from and how many times it was
+ * tried)
+ */
+func deadLetter(req leaseReq, m *msg, tries uint32, logsR logsRoutine) error {
+	name := req.leasing.dead
+	if len(name) == 0 {
+		name = req.logR.name + DeadLogSfx
+	}
+	logR, err := getLog(name, logsR, true)
+	if err != nil {
+		return err
+	}
+
+	hdrs := map[string]string{}
+	for k, v := range m.meta.hdrs {
+		hdrs[k] = v
+	}
+	hdrs["dead-log"] = req.logR.name
+	hdrs["dead-num"] = strconv.FormatUint(m.num, 10)
+	hdrs["dead-group"] = req.group
+	hdrs["dead-tries"] = strconv.FormatUint(uint64(tries), 10)
+
+	c := make(chan putReqResp)
+	err = send(logR, logR.put, putReq{
+		data: m.data,
+		meta: recMeta{key: m.meta.key, hdrs: hdrs},
+		resp: c,
+	})
+	if err != nil {
+		return err
+	}
+	return (<-c).err
+}
+
+/*    understand/
+ * lease ids are random so workers can't guess (and ack) each other's
+ * leases
+ */
+func leaseID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*    way/
+ * find the names of all logs on disk
+ */
+func logNames(dbloc string) ([]string, error) {
+	files, err := ioutil.ReadDir(dbloc)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range files {
+		if isHidden(f.Name()) || f.IsDir() {
+			continue
+		}
+		names = append(names, f.Name())
+	}
+
+	return names, nil
+}
+
+/*    understand/
+ * we follow the leader we are configured to - unless we have been
+ * promoted from it
+ */
+func following(cfg *config, logsR logsRoutine) bool {
+	if len(cfg.follow) == 0 {
+		return false
+	}
+	leader := logsR.promoted.Load()
+	return leader == nil || *leader != cfg.follow
+}
+
+/*    understand/
+ * logs kaf keeps about itself (audit, transaction intents and stats)
+ * belong to each instance so aren't replicated
+ */
+func isLocal(name string) bool {
+	return name == AuditLog || name == TxnLog || name == "_kaf"
+}
+
+/*    way/
+ * while we are following a leader, bring our logs up to date with it's
+ * every second (logging when that fails or starts working again). When
+ * asked to promote us, catch up one last time then note that we have
+ * been promoted from the leader so we stop following it. If we can't
+ * catch up we are only promoted when forced.
+ */
+func followGo(cfgs *atomic.Pointer[config], f chan promoteReq, logsR logsRoutine) {
+	ticker := time.NewTicker(FollowEvery)
+	client := &http.Client{Timeout: 10 * time.Second}
+	var lastErr string
+
+	for {
+		select {
+		case <-ticker.C:
+			cfg := cfgs.Load()
+			if !following(cfg, logsR) {
+				continue
+			}
+			err := follow_(cfg, client, logsR)
+			if err != nil && err.Error() != lastErr {
+				log.Println("follow:", err)
+				lastErr = err.Error()
+			} else if err == nil && len(lastErr) > 0 {
+				log.Println("follow: caught up with", cfg.follow)
+				lastErr = ""
+			}
+
+		case req := <-f:
+			cfg := cfgs.Load()
+			if err := follow_(cfg, client, logsR); err != nil {
+				log.Println("promote: could not catch up:", err)
+				if !req.force {
+					req.resp <- fmt.Errorf("%w: %s", errBehind, err)
+					continue
+				}
+			}
+			leader := cfg.follow
+			err := ioutil.WriteFile(filepath.Join(cfg.dbloc, PromotedFile), []byte(leader), 0644)
+			if err == nil {
+				logsR.promoted.Store(&leader)
+				log.Println("Promoted - no longer following", leader)
+			}
+			req.resp <- err
+		}
+	}
+}
+
+/*    way/
+ * find the last message of every log the leader has and, for those we
+ * are behind on, get the messages we don't have and put them into our
+ * log (with the same numbers). If our log differs from the leader's
+ * (it was deleted and created again, or restored) we archive and
+ * delete ours so it is replicated afresh.
+ */
+func follow_(cfg *config, client *http.Client, logsR logsRoutine) error {
+	var leader struct {
+		Logs []struct {
+			Name string `json:"name"`
+			Last uint64 `json:"last"`
+		} `json:"logs"`
+	}
+	resp, err := fetch(cfg, client, "/stats")
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&leader)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("%s/stats: %s", cfg.follow, err)
+	}
+
+	lasts := map[string]uint64{}
+	logRs, closed := logsR.reg.all()
+	for _, logR := range logRs {
+		if stats, err := peekStats(logR); err == nil {
+			lasts[logR.name] = stats.lastmsg
+		}
+	}
+	for name, meta := range closed {
+		lasts[name] = meta.lastmsg
+	}
+
+	var ferr error
+	for _, l := range leader.Logs {
+		if isHidden(l.Name) || isLocal(l.Name) || strings.Contains(l.Name, "/") {
+			continue
+		}
+		last, ok := lasts[l.Name]
+		if !ok {
+			last, err = lastMsg(l.Name, logsR)
+		}
+		if err == nil && l.Last < last {
+			err = errDiverged
+		}
+		for err == nil && last < l.Last {
+			var upto uint64
+			upto, err = followLog(l.Name, last, cfg, client, logsR)
+			if upto == last {
+				break
+			}
+			last = upto
+		}
+		if err == errDiverged {
+			err = resync(l.Name, cfg, logsR)
+		}
+		if err != nil && ferr == nil {
+			ferr = fmt.Errorf("%s: %s", l.Name, err)
+		}
+		err = nil
+	}
+	return ferr
+}
+
+/*    way/
+ * archive and delete our copy of a log that differs from the leader's
+ * (recording it in the audit log) so it is replicated afresh
+ */
+func resync(name string, cfg *config, logsR logsRoutine) error {
+	c := make(chan deleteReqResp)
+	logsR.d <- deleteReq{name, true, c}
+	resp := <-c
+	params := map[string]string{
+		"log":      name,
+		"archive":  "true",
+		"archived": strconv.FormatUint(resp.upto, 10),
+		"reason":   "diverged",
+	}
+	audit(cfg, logsR, "delete", nil, params, resp.err)
+	if resp.err != nil {
+		return resp.err
+	}
+	log.Println("follow:", name, "differs from the leader's - archived upto", resp.upto, "to replicate it afresh")
+	return nil
+}
+
+func lastMsg(name string, logsR logsRoutine) (uint64, error) {
+	logR, err := getLog(name, logsR, false)
+	if err != nil || logR == nil {
+		return 0, err
+	}
+	stats, err := peekStats(logR)
+	return stats.lastmsg, err
+}
+
+/*    way/
+ * get the leader's messages from the last one we have and put the ones
+ * after it into our log - creating it to start where the leader's
+ * messages start if we don't have it yet. Committed offsets in the
+ * _consumers log are noted as we put them. Returns the last message we
+ * now have.
+ *
+ *    understand/
+ * the leader's copy of our last message tells us it is still the same
+ * log - unless it's gone (compacted or archived) and we can't tell. Our
+ * copy may be noted as arriving later than the leader's (see put_) but
+ * never earlier.
+ */
+func followLog(name string, last uint64, cfg *config, client *http.Client, logsR logsRoutine) (uint64, error) {
+	from := strconv.FormatUint(last+1, 10)
+	if last > 0 {
+		from = strconv.FormatUint(last, 10)
+	}
+	resp, err := fetch(cfg, client, "/get/"+url.PathEscape(name)+"?from="+from+"&meta=true")
+	if err != nil {
+		return last, err
+	}
+	msgs, err := readKafMsgs(bufio.NewReader(resp.Body))
+	resp.Body.Close()
+	if err != nil || len(msgs) == 0 {
+		return last, err
+	}
+
+	logR, err := getLog(name, logsR, false)
+	if err == nil && logR != nil && msgs[0].num == last {
+		m, err := leaseMsg(logR, last)
+		if err != nil {
+			return last, err
+		}
+		if m != nil && m.num == last && (m.meta.at < msgs[0].meta.at || !bytes.Equal(m.data, msgs[0].data)) {
+			return last, errDiverged
+		}
+	}
+	for len(msgs) > 0 && msgs[0].num <= last {
+		msgs = msgs[1:]
+	}
+	if err == nil && logR == nil && len(msgs) > 0 {
+		if err := createReplica(name, msgs[0].num-1, cfg.dbloc); err != nil {
+			return last, err
+		}
+		logR, err = getLog(name, logsR, false)
+	}
+	if err != nil {
+		return last, err
+	}
+
+	c := make(chan putReqResp)
+	o := make(chan offsetReqResp)
+	for _, m := range msgs {
+		err := send(logR, logR.put, putReq{
+			data: m.data,
+			meta: m.meta,
+			roll: cfg.logCfg(name).roll,
+			num:  m.num,
+			resp: c,
+		})
+		if err != nil {
+			return last, err
+		}
+		if resp := <-c; resp.err != nil {
+			return last, resp.err
+		}
+		last = m.num
+
+		var rec offsetRec
+		switch {
+		case name != ConsumerLog:
+		case len(m.data) == 0:
+			if lname, consumer, ok := strings.Cut(m.meta.key, "/"); ok {
+				logsR.o <- offsetReq{log: lname, consumer: consumer, drop: true, saved: true, resp: o}
+				<-o
+			}
+		case json.Unmarshal(m.data, &rec) == nil:
+			logsR.o <- offsetReq{log: rec.Log, consumer: rec.Consumer, upto: rec.Upto, saved: true, resp: o}
+			<-o
+		}
+	}
+	return last, nil
+}
+
+/*    way/
+ * create the log file in a hidden file and link it in (so we don't
+ * clobber a log that was created in the meantime)
+ */
+func createReplica(name string, start uint64, dbloc string) error {
+	tmp := filepath.Join(dbloc, "."+name+".replica")
+	if err := createLogFile(tmp, start); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, filepath.Join(dbloc, name)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*    way/
+ * make a GET request to the leader (presenting our token if we have
+ * one) - returning any error it responds with
+ */
+func fetch(cfg *config, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", cfg.follow+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.ftoken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+cfg.ftoken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s%s: %s %s", cfg.follow, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+/*    way/
+ * read the messages in a kaf format response (see kafFormat) - the
+ * response header with the number of messages followed by each record
+ */
+func readKafMsgs(rd *bufio.Reader) ([]*msg, error) {
+	hdr, err := rd.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	hdr = strings.TrimSuffix(hdr, "\n")
+	if !strings.HasPrefix(hdr, RespHeaderPfx+"|") {
+		return nil, errors.New("invalid response header")
+	}
+	n, err := strconv.Atoi(hdr[len(RespHeaderPfx)+1:])
+	if err != nil {
+		return nil, errors.New("invalid response header")
+	}
+
+	var msgs []*msg
+	for i := 0; i < n; i++ {
+		line, err := rd.ReadString('\n')
+		for err == nil && line == "\n" {
+			line, err = rd.ReadString('\n')
+		}
+		if err != nil {
+			return nil, err
+		}
+		f := strings.SplitN(strings.TrimSuffix(line, "\n"), "|", 4)
+		if len(f) < 3 || f[0]+"|" != RecHeaderPfx[1:] {
+			return nil, errors.New("invalid record header")
+		}
+		num, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid record header message number")
+		}
+		sz, err := strconv.ParseUint(f[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid record header message size")
+		}
+		var meta recMeta
+		if len(f) == 4 {
+			if meta, err = decodeMeta(f[3]); err != nil {
+				return nil, err
+			}
+		}
+		data := make([]byte, sz)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &msg{num: num, sz: sz, meta: meta, data: data})
+	}
+	return msgs, nil
+}
+
+/*    way/
+ * periodically post statistics of all logs that have activity
+ */
+func statsGo(logsR logsRoutine, lim limiter) {
+	ticker := time.NewTicker(5 * time.Minute)
+	c := make(chan stats)
+	var b strings.Builder
+
+	var statCount uint32 = 0
+	for {
+		start := time.Now()
+
+		<-ticker.C
+		statCount++
+
+		offsets := getOffsets(logsR)
+
+		allstats := []stats{}
+		logRs, _ := logsR.reg.all()
+		for _, logR := range logRs {
+			if send(logR, logR.stat, statReq{resp: c}) != nil {
+				continue
+			}
+			stats := <-c
+			if stats.name == "_kaf" {
+				continue
+			}
+			if hasActivity(stats) || isLagging(stats, offsets[stats.name]) {
+				allstats = append(allstats, stats)
+			}
+		}
+
+		throttled := lim.throttled()
+
+		end := time.Now()
+
+		if len(allstats) == 0 && throttled == 0 {
+			continue
+		}
+
+		statsJSON(allstats, offsets, statCount, throttled, start, end, &b)
+
+		if _, err := putLog("_kaf", []byte(b.String()), logsR); err != nil {
+			log.Println(err)
+		}
+
+	}
+}
+
+/*    way/
+ * periodically archive messages logs no longer need to keep, then
+ * compress or delete archived files that are old enough. Logs that
+ * aren't open (and have retention rules) are opened, retained and
+ * closed again - once after we start or the config changes and then
+ * every ColdRetainEvery (as they aren't getting new messages, only
+ * older). In between, we compress the archives logs have just made as
+ * they come in.
+ */
+func retentionGo(cfgs *atomic.Pointer[config], logsR logsRoutine) {
+	ticker := time.NewTicker(time.Minute)
+	var lastCfg *config
+	var retained map[string]time.Time
+
+	for {
+		select {
+		case loc := <-logsR.z:
+			if fileExists(loc) {
+				name, _, _ := parseArchiveName(filepath.Base(loc))
+				compressArchive(cfgs.Load(), logsR, name, loc)
+			}
+			continue
+		case <-ticker.C:
+		}
+		cfg := cfgs.Load()
+		if cfg != lastCfg {
+			lastCfg, retained = cfg, map[string]time.Time{}
+		}
+
+		open := map[string]bool{}
+		logRs, _ := logsR.reg.all()
+		for _, logR := range logRs {
+			open[logR.name] = true
+			retainLog(cfg, logsR, logR)
+		}
+
+		names, err := logNames(cfg.dbloc)
+		if err != nil {
+			log.Println("retention:", err)
+		}
+		for _, name := range names {
+			if open[name] || !hasRules(cfg.logCfg(name), name) {
+				continue
+			}
+			if at, ok := retained[name]; ok && time.Since(at) < ColdRetainEvery {
+				continue
+			}
+			logR, err := getLog(name, logsR, false)
+			if err != nil || logR == nil {
+				continue
+			}
+			since := time.Now()
+			retainLog(cfg, logsR, logR)
+			retained[name] = since
+			c := make(chan logReqResp)
+			logsR.c <- logReq{name: name, close: true, since: since, resp: c}
+			<-c
+		}
+
+		expireArchives(cfg, logsR)
+	}
+}
+
+func hasRules(lc logCfg, name string) bool {
+	k := lc.keep
+	return lc.compact || name == ConsumerLog || k.msgs > 0 || k.size > 0 || k.age > 0
+}
+
+/*    way/
+ * compact the log (if it should be) and archive the messages it no
+ * longer needs to keep - recording it in the audit log
+ */
+func retainLog(cfg *config, logsR logsRoutine, logR *logRoutine) {
+	lc := cfg.logCfg(logR.name)
+	if lc.compact || logR.name == ConsumerLog {
+		compactLog(cfg, logsR, logR, nil)
+	}
+
+	k := lc.keep
+	if k.msgs == 0 && k.size == 0 && k.age == 0 {
+		return
+	}
+	c := make(chan retainReqResp)
+	if send(logR, logR.ret, retainReq{k, c}) != nil {
+		return
+	}
+	resp := <-c
+	if resp.upto == 0 && resp.err == nil {
+		return
+	}
+	params := map[string]string{
+		"log":    logR.name,
+		"upto":   strconv.FormatUint(resp.upto, 10),
+		"reason": "retention",
+	}
+	audit(cfg, logsR, "archive", nil, params, resp.err)
+}
+
+/*    way/
+ * ask the log to compact itself, recording it in the audit log if it
+ * was asked for (or if anything was removed)
+ */
+func compactLog(cfg *config, logsR logsRoutine, logR *logRoutine, r *http.Request) (uint64, error) {
+	c := make(chan compactReqResp)
+	if err := send(logR, logR.cmp, compactReq{c}); err != nil {
+		return 0, err
+	}
+	resp := <-c
+	if r != nil || resp.removed > 0 || resp.err != nil {
+		params := map[string]string{
+			"log":     logR.name,
+			"removed": strconv.FormatUint(resp.removed, 10),
+		}
+		audit(cfg, logsR, "compact", r, params, resp.err)
+	}
+	return resp.removed, resp.err
+}
+
+/*    way/
+ * walk through the archived files, compressing or deleting those that
+ * are older than their log's settings allow
+ */
+func expireArchives(cfg *config, logsR logsRoutine) {
+	files, err := ioutil.ReadDir(cfg.dbloc)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, f := range files {
+		name, t, ok := parseArchiveName(f.Name())
+		if !ok {
+			continue
+		}
+		age := time.Since(t)
+		k := cfg.logCfg(name).keep
+		loc := path.Join(cfg.dbloc, f.Name())
+		params := map[string]string{"log": name, "archive": f.Name()}
+
+		if k.deleteAfter > 0 && age > k.deleteAfter {
+			err := os.Remove(loc)
+			archivesChanged(name, logsR)
+			audit(cfg, logsR, "delete", nil, params, err)
+			continue
+		}
+		compress := k.compressNow || (k.compressAfter > 0 && age > k.compressAfter)
+		if compress && !strings.HasSuffix(f.Name(), ".gz") {
+			compressArchive(cfg, logsR, name, loc)
+		}
+	}
+}
+
+/*    way/
+ * compress the archive, letting it's log know and recording it in the
+ * audit log
+ */
+func compressArchive(cfg *config, logsR logsRoutine, name, loc string) {
+	err := compressFile(loc)
+	archivesChanged(name, logsR)
+	params := map[string]string{"log": name, "archive": filepath.Base(loc)}
+	audit(cfg, logsR, "compress", nil, params, err)
+}
+
+/*    way/
+ * let the log (if it is open) know it's archives have changed
+ */
+func archivesChanged(name string, logsR logsRoutine) {
+	if logR := logsR.reg.find_(name); logR != nil {
+		logR.archsChanged.Store(true)
+	}
+}
+
+/*    understand/
+ * archived files are named --<name>--<time>, optionally followed by a
+ * -<n> suffix (when there was already an archive at that time) and a
+ * .gz suffix (when compressed)
+ */
+func parseArchiveName(fname string) (string, time.Time, bool) {
+	if !strings.HasPrefix(fname, "--") {
+		return "", time.Time{}, false
+	}
+	fname = strings.TrimSuffix(fname[2:], ".gz")
+	i := strings.LastIndex(fname, "--")
+	if i < 1 {
+		return "", time.Time{}, false
+	}
+	name, ts := fname[:i], fname[i+2:]
+
+	const layout = "2006-01-02T15_04_05Z07_00"
+	t, err := time.Parse(layout, ts)
+	if j := strings.LastIndex(ts, "-"); err != nil && j > 0 {
+		if _, e := strconv.Atoi(ts[j+1:]); e == nil {
+			t, err = time.Parse(layout, ts[:j])
+		}
+	}
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name, t, true
+}
+
+/*    way/
+ * copy the file to a new file (which must not already exist) keeping
+ * it's modification time
+ */
+func copyFile(src, dst string) error {
+	inf, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, inf.ModTime(), inf.ModTime())
+}
+
+/*    way/
+ * gzip the file alongside the original (keeping it's modification time)
+ * and then remove the original
+ */
+func compressFile(loc string) error {
+	inf, err := os.Stat(loc)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	zloc := loc + ".gz"
+	dst, err := os.OpenFile(zloc, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(zloc)
+		return err
+	}
+
+	os.Chtimes(zloc, inf.ModTime(), inf.ModTime())
+	return os.Remove(loc)
+}
+
+/*    understand/
+ * ignore empty filenames, dot files, and 'archived' files i(those
+ * starting with --)
+ */
+func isHidden(name string) bool {
+	if len(name) == 0 {
+		return true
+	}
+	if name[0] == '.' {
+		return true
+	}
+	if strings.HasPrefix(name, "--") {
+		return true
+	}
+	return false
+}
+
+/*    understand/
+ * logs that kaf writes to itself and that can't be put to directly
+ */
+func isReserved(name string) bool {
+	return name == AuditLog || name == TxnLog || name == ConsumerLog
+}
+
+/*    understand/
+ * we count a log as having activity if it has any get or put requests
+ * or any errors
+ */
+func hasActivity(stats stats) bool {
+	return stats.getCount+stats.putCount > 0 || stats.errCount > 0
+}
+
+/*    understand/
+ * a log is lagging if any consumer has committed an offset behind it's
+ * last message
+ */
+func isLagging(stats stats, consumers map[string]uint64) bool {
+	for _, upto := range consumers {
+		if lag(stats.lastmsg, upto) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/*    understand/
+ * the number of messages a consumer has yet to commit
+ */
+func lag(last, upto uint64) uint64 {
+	if upto >= last {
+		return 0
+	}
+	return last - upto
+}
+
+/*    way/
+ * convert all the stats received to a JSON report (with the lag of
+ * every consumer of the log)
+ */
+func statsJSON(allstats []stats, offsets map[string]map[string]uint64,
+	statCount, throttled uint32, start, end time.Time,
+	b *strings.Builder) {
+
+	b.Reset()
+
+	b.WriteString(`{"start":"`)
+	b.WriteString(start.UTC().Format(time.RFC3339))
+	b.WriteString(`","end":"`)
+	b.WriteString(end.UTC().Format(time.RFC3339))
+	fmt.Fprintf(b, `","statno":%d,`, statCount)
+	if throttled > 0 {
+		fmt.Fprintf(b, `"throttled":%d,`, throttled)
+	}
+	b.WriteString(`"logs":[`)
+
+	for i, stats := range allstats {
+
+		if stats.errCount > 0 {
+			fmt.Fprintf(b,
+				`{"name":"%s","last":%d,"gets":%d,"puts":%d,"errs":%d`,
+				stats.name,
+				stats.lastmsg,
+				stats.getCount, stats.putCount,
+				stats.errCount)
+		} else if hasActivity(stats) {
+			fmt.Fprintf(b,
+				`{"name":"%s","last":%d,"gets":%d,"puts":%d`,
+				stats.name,
+				stats.lastmsg,
+				stats.getCount, stats.putCount)
+		} else {
+			fmt.Fprintf(b,
+				`{"name":"%s","last":%d`,
+				stats.name,
+				stats.lastmsg)
+		}
+
+		if consumers := offsets[stats.name]; len(consumers) > 0 {
+			lags := map[string]uint64{}
+			for consumer, upto := range consumers {
+				lags[consumer] = lag(stats.lastmsg, upto)
+			}
+			data, _ := json.Marshal(lags)
+			b.WriteString(`,"lag":`)
+			b.Write(data)
+		}
+		b.WriteRune('}')
+
+		if i != len(allstats)-1 {
+			b.WriteRune(',')
+		}
+	}
+
+	b.WriteString("]}")
+}
+
+/*    way/
+ * start up the rate limiter goroutine
+ */
+func getLimiter() limiter {
+	c := make(chan limitReq)
+	t := make(chan chan uint32)
+	go limiterGo(c, t)
+	return limiter{c, t}
+}
+
+/*    way/
+ * helper function that asks the limiter to take a request's share of
+ * the limits, returning how long to wait if it is over any of them
+ */
+func (lim limiter) take(client, name string, sz int64, clientL, logL limits) time.Duration {
+	c := make(chan time.Duration)
+	lim.c <- limitReq{
+		client:  client,
+		log:     name,
+		sz:      sz,
+		clientL: clientL,
+		logL:    logL,
+		resp:    c,
+	}
+	return <-c
+}
+
+/*    way/
+ * helper function that gets (and resets) the number of throttled
+ * requests
+ */
+func (lim limiter) throttled() uint32 {
+	c := make(chan uint32)
+	lim.t <- c
+	return <-c
+}
+
+/*    way/
+ * keep a token bucket for every limit of every client and log. A
+ * request needs to be allowed by all the buckets that apply to it
+ * before it uses any of them up. Periodically we drop buckets that have
+ * filled up again so they don't pile up.
+ */
+func limiterGo(c chan limitReq, t chan chan uint32) {
+	buckets := map[string]*bucket{}
+	prune := time.NewTicker(time.Minute)
+	var throttled uint32
+
+	for {
+		select {
+		case req := <-c:
+			now := time.Now()
+			sz := float64(req.sz)
+			checks := []struct {
+				key  string
+				rate float64
+				cost float64
+			}{
+				{"c|rps|" + req.client, req.clientL.rps, 1},
+				{"c|bps|" + req.client, req.clientL.bps, sz},
+				{"l|rps|" + req.log, req.logL.rps, 1},
+				{"l|bps|" + req.log, req.logL.bps, sz},
+			}
+
+			var wait time.Duration
+			var using []*bucket
+			var costs []float64
+			for _, ch := range checks {
+				if ch.rate <= 0 || ch.cost <= 0 {
+					continue
+				}
+				b := buckets[ch.key]
+				if b == nil {
+					b = &bucket{tokens: ch.rate}
+					buckets[ch.key] = b
+				}
+				b.fill(ch.rate, now)
+				if w := b.wait(ch.cost); w > wait {
+					wait = w
+				}
+				using = append(using, b)
+				costs = append(costs, ch.cost)
+			}
+
+			if wait > 0 {
+				throttled++
+			} else {
+				for i, b := range using {
+					b.tokens -= costs[i]
+				}
+			}
+			req.resp <- wait
+
+		case resp := <-t:
+			resp <- throttled
+			throttled = 0
+
+		case now := <-prune.C:
+			for k, b := range buckets {
+				b.fill(b.rate, now)
+				if b.tokens >= b.burst() {
+					delete(buckets, k)
+				}
+			}
+		}
+	}
+}
+
+/*    way/
+ * add the tokens for the time passed since we last filled up
+ */
+func (b *bucket) fill(rate float64, now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	b.rate = rate
+	b.last = now
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+func (b *bucket) burst() float64 {
+	return math.Max(b.rate, 1)
+}
+
+/*    understand/
+ * how long till the bucket has enough tokens. A cost larger than the
+ * bucket can ever hold is allowed once the bucket is full (and leaves
+ * it in debt).
+ */
+func (b *bucket) wait(cost float64) time.Duration {
+	need := math.Min(cost, b.burst())
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+func fileExists(loc string) bool {
+	info, err := os.Stat(loc)
+	if os.IsNotExist(err) {
+		return false
+	}
+	return !info.IsDir()
+}
+
+/*    way/
+ * create the requested db file with header.
+ */
+func createLogFile(loc string, lastmsg uint64) error {
+	f, err := os.OpenFile(loc, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	no := strconv.FormatUint(lastmsg, 10)
+	f.Write([]byte(DBHeader))
+	f.Write([]byte(no))
+	return nil
+}
+
+/*    way/
+ * return the stats of the log, resetting it's counts unless we are only
+ * peeking
+ */
+func stats_(req statReq, msglog *msgLog) stats {
+	stats := stats(*msglog)
+	if !req.peek {
+		msglog.getCount = 0
+		msglog.putCount = 0
+		msglog.achCount = 0
+		msglog.errCount = 0
+	}
+	return stats
+}
+
+/*    way/
+ * load records from the log file and, and set up a goroutine to handle
+ * requests - noting when it was last used (stats, retention and
+ * compaction are housekeeping so don't count) so we know if it has been
+ * idle long enough to close. While a transaction is prepared on the log
+ * we only answer stats and refuse to stop or archive (so whoever asked -
+ * like logsGo deleting the log - doesn't wait on the transaction which
+ * may itself be waiting on them).
+ */
+func loadLogR(name, loc string, z chan string) (*logRoutine, error) {
+	msglog := &msgLog{
+		name:         name,
+		loc:          loc,
+		archsChanged: &atomic.Bool{},
+		toCompress:   z,
+	}
+	err := loadLogFile(msglog)
+	if err != nil {
+		return nil, err
+	}
+
+	g := make(chan getReq)
+	p := make(chan putReq)
+	s := make(chan statReq)
+	a := make(chan archiveReq)
+	r := make(chan retainReq)
+	cm := make(chan compactReq)
+	tx := make(chan prepareReq)
+	ls := make(chan listReq)
+	st := make(chan stopReq)
+	done := make(chan struct{})
+	go func() {
+		used := time.Now()
+		for {
+			select {
+			case req := <-g:
+				used = time.Now()
+				req.resp <- get_(req, msglog)
+			case req := <-p:
+				used = time.Now()
+				req.resp <- put_(req, msglog)
+			case req := <-a:
+				used = time.Now()
+				if req.exact {
+					req.resp <- archiveExact(req.upto, req.compress, msglog)
+				} else {
+					req.resp <- archive_(req.upto, req.compress, msglog)
+				}
+			case req := <-r:
+				req.resp <- retain_(req.keep, msglog)
+			case req := <-cm:
+				req.resp <- compact_(msglog)
+			case req := <-ls:
+				used = time.Now()
+				req.resp <- list_(msglog)
+			case req := <-tx:
+				used = time.Now()
+				err := prepare_(req.puts, req.quota, msglog)
+				req.resp <- err
+				if err != nil {
+					continue
+				}
+				var cr commitReq
+			prepared:
+				for {
+					select {
+					case cr = <-req.next:
+						break prepared
+					case req := <-st:
+						req.resp <- stopReqResp{false, 0}
+					case req := <-a:
+						req.resp <- achReqResp{0, errLogBusy}
+					case req := <-s:
+						req.resp <- stats_(req, msglog)
+					}
+				}
+				if cr.commit {
+					cr.resp <- commit_(req.puts, req.roll, cr, msglog)
+				} else {
+					cr.resp <- txnPutsResp{}
+				}
+			case req := <-s:
+				req.resp <- stats_(req, msglog)
+			case req := <-st:
+				if time.Since(used) < req.idle {
+					req.resp <- stopReqResp{false, 0}
+					continue
+				}
+				lastmsg := msglog.lastmsg
+				closeLog(msglog)
+				close(done)
+				req.resp <- stopReqResp{true, lastmsg}
+				return
+			}
+		}
+	}()
+
+	return &logRoutine{
+		name: name,
+		get:  g,
+		put:  p,
+		ach:  a,
+		ret:  r,
+		cmp:  cm,
+		txn:  tx,
+		lst:  ls,
+		stat: s,
+		stop: st,
+		done: done,
+
+		archsChanged: msglog.archsChanged,
+	}, nil
+}
+
+/*    way/
+ * close the log's segments and any archives we have uncompressed
+ */
+func closeLog(msglog *msgLog) {
+	for _, a := range msglog.archives {
+		a.closeRaw()
+	}
+	clearMsgLog(msglog)
+}
+
+/*    way/
+ * move every segment whose messages are all upto the given message to
+ * an archive file (rolling over the log file first if everything is to
+ * be archived) and forget their messages. The first segment that has
+ * later messages is kept, so a few more messages than asked for may be
+ * kept. If asked, each archive is queued to be compressed in the
+ * background (see retentionGo) - retention compresses any that don't
+ * fit in the queue when it next runs. Compressing here would hold up
+ * every get and put to the log.
+ */
+func archive_(upto uint64, compress bool, msglog *msgLog) achReqResp {
+	msglog.achCount++
+
+	if msgCount(msglog) == 0 {
+		return achReqResp{0, errors.New("empty logfile: nothing toarchive")}
+	}
+	if upto == 0 {
+		return achReqResp{0, errors.New("message to archive upto not given")}
+	}
+
+	if upto >= msglog.lastmsg {
+		if err := roll_(msglog); err != nil {
+			msglog.errCount++
+			return achReqResp{0, err}
+		}
+	}
+
+	var archived uint64
+	t := time.Now().UTC().Format("2006-01-02T15_04_05Z07_00")
+	aname := fmt.Sprintf("--%s--%s", msglog.name, t)
+	for len(msglog.segs) > 1 {
+		seg := msglog.segs[0]
+		last := seg.start
+		if seg.n > 0 {
+			last = seg.last
+		}
+		if last > upto {
+			break
+		}
+
+		aloc := filepath.Join(filepath.Dir(msglog.loc), aname)
+		for i := 2; fileExists(aloc) || fileExists(aloc+".gz"); i++ {
+			aloc = filepath.Join(filepath.Dir(msglog.loc), fmt.Sprintf("%s-%d", aname, i))
+		}
+		if err := os.Rename(seg.loc, aloc); err != nil {
+			msglog.errCount++
+			msglog.archList = nil
+			forgetUpto(archived, msglog)
+			return achReqResp{archived, err}
+		}
+		seg.f.Close()
+		os.Remove(idxLoc(seg.loc))
+		if compress {
+			select {
+			case msglog.toCompress <- aloc:
+			default:
+			}
+		}
+
+		msglog.segs = msglog.segs[1:]
+		msglog.size -= seg.size
+		msglog.start = msglog.segs[0].start
+		msglog.archList = nil
+		archived = last
+	}
+
+	forgetUpto(archived, msglog)
+	return achReqResp{archived, nil}
+}
+
+/*    way/
+ * archive upto the message - unless it is in the log file (but isn't
+ * it's last message) when we can't archive upto it without archiving
+ * later messages too, so we respond with what we could archive upto
+ * instead
+ */
+func archiveExact(upto uint64, compress bool, msglog *msgLog) achReqResp {
+	active := msglog.segs[len(msglog.segs)-1]
+	if upto < msglog.lastmsg && active.n > 0 && upto >= active.idx[0].num {
+		return achReqResp{active.start, errInLogFile}
+	}
+	return archive_(upto, compress, msglog)
+}
+
+/*    way/
+ * forget the key's messages that are no longer in the log
+ */
+func forgetUpto(upto uint64, msglog *msgLog) {
+	if upto == 0 {
+		return
+	}
+	for key, nums := range msglog.keys {
+		i := sort.Search(len(nums), func(i int) bool { return nums[i] > upto })
+		if i == len(nums) {
+			delete(msglog.keys, key)
+		} else if i > 0 {
+			msglog.keys[key] = append([]uint64{}, nums[i:]...)
+		}
+	}
+}
+
+/*    way/
+ * if the log file has messages, roll it over to a new segment. So we
+ * don't lose messages if we stop part way, create the new log file
+ * alongside, link the log file to it's segment name, and then rename the
+ * new log file over it.
+ */
+func roll_(msglog *msgLog) error {
+	active := msglog.segs[len(msglog.segs)-1]
+	if active.n == 0 {
+		return nil
+	}
+
+	tmploc := filepath.Join(filepath.Dir(msglog.loc), "."+msglog.name+".roll")
+	os.Remove(tmploc)
+	if err := createLogFile(tmploc, msglog.lastmsg); err != nil {
+		return err
+	}
+	sloc := segmentLoc(msglog, active.start)
+	if err := os.Link(msglog.loc, sloc); err != nil {
+		os.Remove(tmploc)
+		return err
+	}
+	if err := os.Rename(tmploc, msglog.loc); err != nil {
+		os.Remove(sloc)
+		os.Remove(tmploc)
+		return err
+	}
+	active.loc = sloc
+	os.Rename(idxLoc(msglog.loc), idxLoc(sloc))
+
+	seg, _, err := openSegment(msglog.loc)
+	if err != nil {
+		return err
+	}
+	msglog.segs = append(msglog.segs, seg)
+	msglog.size += seg.size
+	return nil
+}
+
+/*    understand/
+ * the log file is rolled over when it reaches the segment size (or
+ * it's first message is older than the segment age)
+ */
+func shouldRoll(r rolling, msglog *msgLog) bool {
+	active := msglog.segs[len(msglog.segs)-1]
+	if active.n == 0 {
+		return false
+	}
+	size := r.size
+	if size == 0 {
+		size = DefaultSegmentSize
+	}
+	if active.size >= size {
+		return true
+	}
+	return r.age > 0 && active.at != 0 && time.Since(time.UnixMilli(active.at)) >= r.age
+}
+
+/*    way/
+ * work out the last message we do not need to keep - because there are
+ * more messages than we want to keep, because the log is bigger than we
+ * want to keep, or because the message is older than we want to keep -
+ * and archive upto that message. If that is in the log file we roll it
+ * over so it can be archived once all it's messages are not needed.
+ */
+func retain_(k keep, msglog *msgLog) retainReqResp {
+	var upto uint64
+
+	if n := msgCount(msglog); k.msgs > 0 && n > k.msgs {
+		pos, ok, err := seekOrd(int(n-k.msgs-1), msglog)
+		if err != nil {
+			msglog.errCount++
+			return retainReqResp{0, err}
+		}
+		if ok {
+			upto = pos.m.num
+		}
+	}
+	if k.size > 0 && msglog.size > k.size {
+		var after int64
+		for i := len(msglog.segs) - 1; i >= 0; i-- {
+			seg := msglog.segs[i]
+			if after+seg.size <= k.size {
+				after += seg.size
+				continue
+			}
+			pos, ok, err := seekSeg(i, func(mo msgOff) bool {
+				return after+seg.size-mo.offset <= k.size
+			}, msglog)
+			if err != nil {
+				msglog.errCount++
+				return retainReqResp{0, err}
+			}
+			last := seg.last
+			if ok {
+				last = pos.m.num - 1
+			}
+			if seg.n > 0 && last > upto {
+				upto = last
+			}
+			break
+		}
+	}
+	if k.age > 0 {
+		cutoff := time.Now().Add(-k.age).UnixMilli()
+		pos, ok, err := seekMsg(func(mo msgOff) bool {
+			return mo.at >= cutoff
+		}, msglog)
+		if err != nil {
+			msglog.errCount++
+			return retainReqResp{0, err}
+		}
+		last := uint64(0)
+		if ok {
+			last = pos.m.num - 1
+		} else {
+			for i := len(msglog.segs) - 1; i >= 0; i-- {
+				if seg := msglog.segs[i]; seg.n > 0 {
+					if seg.lastAt != 0 {
+						last = seg.last
+					}
+					break
+				}
+			}
+		}
+		if last > upto {
+			upto = last
+		}
+	}
+
+	if upto == 0 {
+		return retainReqResp{0, nil}
+	}
+	active := msglog.segs[len(msglog.segs)-1]
+	if upto < msglog.lastmsg && active.n > 0 && upto >= active.idx[0].num {
+		if err := roll_(msglog); err != nil {
+			msglog.errCount++
+			return retainReqResp{0, err}
+		}
+	}
+	resp := archive_(upto, k.compressNow, msglog)
+	return retainReqResp{resp.upto, resp.err}
+}
+
+/*    way/
+ * find all the messages that have a later message with the same key. If
+ * there are any, copy every other record of each segment that has them
+ * (unchanged - so message numbers are kept) into a new file next to the
+ * segment, rename it over the segment, and reload the log.
+ *
+ *    understand/
+ * a message with a key but no data is a tombstone - marking the key as
+ * deleted. As the latest message of it's key it is kept like any other.
+ */
+func compact_(msglog *msgLog) compactReqResp {
+	if err := loadKeys(msglog); err != nil {
+		msglog.errCount++
+		return compactReqResp{0, err}
+	}
+
+	drop := map[uint64]bool{}
+	for _, nums := range msglog.keys {
+		for _, num := range nums[:len(nums)-1] {
+			drop[num] = true
+		}
+	}
+	if len(drop) == 0 {
+		return compactReqResp{0, nil}
+	}
+
+	for _, seg := range msglog.segs {
+		if err := compactSegment(seg, drop, msglog); err != nil {
+			msglog.errCount++
+			return compactReqResp{0, err}
+		}
+	}
+
+	return compactReqResp{uint64(len(drop)), loadLogFile(msglog)}
+}
+
+/*    way/
+ * if the segment has any of the messages to drop, copy it's other
+ * records into a new file and rename that over it - removing it's index
+ * first as the offsets will no longer match (it is rebuilt when the log
+ * is reloaded)
+ */
+func compactSegment(seg *segment, drop map[uint64]bool, msglog *msgLog) error {
+	dropping := false
+	for num := range drop {
+		if seg.n > 0 && num > seg.start && num <= seg.last {
+			dropping = true
+			break
+		}
+	}
+	if !dropping {
+		return nil
+	}
+
+	tmploc := filepath.Join(filepath.Dir(msglog.loc), "."+msglog.name+".compact")
+	os.Remove(tmploc)
+	if err := createLogFile(tmploc, seg.start); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(tmploc, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Seek(0, 2); err != nil {
+		dst.Close()
+		return err
+	}
+
+	var cperr error
+	err = scanSegment(seg, seg.idx[0].offset, 0, func(m msg, ord int) bool {
+		if drop[m.num] {
+			return true
+		}
+		rec := io.NewSectionReader(seg.f, m.offset, int64(m.start+m.sz))
+		_, cperr = io.Copy(dst, rec)
+		return cperr == nil
+	})
+	if err == nil {
+		err = cperr
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmploc)
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmploc)
+		return err
+	}
+	os.Remove(idxLoc(seg.loc))
+	return os.Rename(tmploc, seg.loc)
+}
+
+/*    problem/
+ * return a few messages (max 5 || size < 3200) to the user
+ *    way/
+ * find the first message >= the number (or arriving at or after the
+ * time) and then walk the next few messages, stopping when too big or
+ * out of bounds. When asked for a key, we walk the key's messages
+ * instead.
+ * NB: Why 3200? We want sizes to be small enough so they fit the
+ * initial congestion window of TCP - we could probably go (much?) higher
+ * but we don't expect large data records anyway so 3200 is reasonable.
+ */
+func get_(req getReq, msglog *msgLog) getReqResp {
+	msglog.getCount++
+
+	if req.archived && req.since == 0 && len(req.key) == 0 && req.num <= msglog.start {
+		resp, ok := getArchived_(req.num, msglog)
+		if ok {
+			return resp
+		}
+	}
+
+	var pos msgPos
+	var ok bool
+	var err error
+	next := func(i int) (msgPos, bool, error) {
+		if i == 0 {
+			if req.since != 0 {
+				return seekMsg(func(mo msgOff) bool { return mo.at >= req.since }, msglog)
+			}
+			return seekMsg(func(mo msgOff) bool { return mo.num >= req.num }, msglog)
+		}
+		return nextMsg(pos, msglog)
+	}
+
+	if len(req.key) > 0 {
+		if err := loadKeys(msglog); err != nil {
+			msglog.errCount++
+			return getReqResp{nil, err}
+		}
+		nums := msglog.keys[req.key]
+		kl := len(nums)
+		var kndx int
+		if req.num == 0 {
+			if kl > 0 {
+				kndx = kl - 1
+			}
+		} else {
+			kndx = sort.Search(len(nums), func(i int) bool {
+				return nums[i] >= req.num
+			})
+		}
+		next = func(i int) (msgPos, bool, error) {
+			if kndx+i >= kl {
+				return msgPos{}, false, nil
+			}
+			num := nums[kndx+i]
+			return seekMsg(func(mo msgOff) bool { return mo.num >= num }, msglog)
+		}
+	}
+
+	var msgs []*msg
+	var tot uint64
+	for i := 0; i < 5; i++ {
+		pos, ok, err = next(i)
+		if err == nil && ok {
+			var m *msg
+			seg := msglog.segs[pos.si]
+			m, err = readMsg(msgOff{pos.m.num, pos.m.offset, pos.m.meta.at, seg}, seg.f)
+			if err == nil {
+				msgs = append(msgs, m)
+				tot += m.sz
+			}
+		}
+		if err != nil {
+			msglog.errCount++
+			return getReqResp{nil, err}
+		}
+		if !ok || tot >= 3200 {
+			break
+		}
+	}
+
+	return getReqResp{msgs, nil}
+}
+
+/*    way/
+ * get messages from before the log file from it's archives. The newest
+ * archive that starts before the message will have it (as each archive
+ * has every message upto where the next starts) so we only need to
+ * read the archive headers to find it. Then we index that archive (if
+ * we haven't already) and read the messages from it - falling through
+ * to newer archives if it has none left, and to the log file itself if
+ * none of them do. If an archive we listed has gone (moved or deleted
+ * by hand) we list them afresh and try again.
+ */
+func getArchived_(num uint64, msglog *msgLog) (getReqResp, bool) {
+	resp, ok := readArchives_(num, msglog)
+	if errors.Is(resp.err, os.ErrNotExist) {
+		msglog.archList = nil
+		resp, ok = readArchives_(num, msglog)
+	}
+	return resp, ok
+}
+
+func readArchives_(num uint64, msglog *msgLog) (getReqResp, bool) {
+	as, err := listArchives(msglog)
+	if err != nil {
+		msglog.errCount++
+		return getReqResp{nil, err}, true
+	}
+
+	i := len(as) - 1
+	for ; i > 0; i-- {
+		if as[i].start < num {
+			break
+		}
+	}
+
+	for ; i >= 0 && i < len(as); i++ {
+		a := as[i]
+		if a.msgOs == nil {
+			if err := indexArchive(a, msglog); err != nil {
+				msglog.errCount++
+				return getReqResp{nil, err}, true
+			}
+		}
+
+		msgs, err := readArchived(a, num, msglog)
+		if err != nil {
+			msglog.errCount++
+			return getReqResp{nil, err}, true
+		}
+		if len(msgs) > 0 {
+			return getReqResp{msgs, nil}, true
+		}
+	}
+
+	return getReqResp{}, false
+}
+
+/*    way/
+ * find the archives of the log (oldest first), reading the header of
+ * any we haven't seen and forgetting those that have gone - unless we
+ * already have them and they haven't changed since
+ */
+func listArchives(msglog *msgLog) ([]*archived, error) {
+	changed := msglog.archsChanged != nil && msglog.archsChanged.Swap(false)
+	if msglog.archList != nil && !changed {
+		return msglog.archList, nil
+	}
+
+	dir := filepath.Dir(msglog.loc)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if msglog.archives == nil {
+		msglog.archives = map[string]*archived{}
+	}
+	seen := map[string]bool{}
+
+	as := []*archived{}
+	for _, f := range files {
+		name, t, ok := parseArchiveName(f.Name())
+		if !ok || name != msglog.name {
+			continue
+		}
+		seen[f.Name()] = true
+
+		a := msglog.archives[f.Name()]
+		if a == nil || a.size != f.Size() {
+			if a != nil {
+				a.closeRaw()
+			}
+			a = &archived{
+				fname:      f.Name(),
+				t:          t,
+				size:       f.Size(),
+				compressed: strings.HasSuffix(f.Name(), ".gz"),
+			}
+			a.start, err = archiveStart(filepath.Join(dir, f.Name()), a.compressed)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", f.Name(), err)
+			}
+			msglog.archives[f.Name()] = a
+		}
+		as = append(as, a)
+	}
+
+	for fname, a := range msglog.archives {
+		if !seen[fname] {
+			a.closeRaw()
+			delete(msglog.archives, fname)
+		}
+	}
+
+	sort.Slice(as, func(i, j int) bool {
+		if as[i].start != as[j].start {
+			return as[i].start < as[j].start
+		}
+		return as[i].t.Before(as[j].t)
+	})
+	msglog.archList = as
+	return as, nil
+}
+
+/*    way/
+ * read the message number the archive starts after from it's header
+ */
+func archiveStart(loc string, compressed bool) (uint64, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var rd io.Reader = f
+	if compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		rd = zr
+	}
+
+	hdr := make([]byte, 32)
+	n, err := io.ReadFull(rd, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	start, _, err := parseDBHeader(hdr[:n])
+	return start, err
+}
+
+/*    way/
+ * open the archive for reading. Compressed archives are uncompressed
+ * (once) into a file that is removed as soon as it is open - so it goes
+ * away when we close it. We only keep the MaxRawArchives most recently
+ * read of these, closing the oldest to make room. Close the returned
+ * file when done.
+ */
+func openArchive(a *archived, msglog *msgLog) (*os.File, func(), error) {
+	dir := filepath.Dir(msglog.loc)
+	loc := filepath.Join(dir, a.fname)
+	if !a.compressed {
+		f, err := os.Open(loc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+	if a.raw != nil {
+		a.rawUsed = time.Now()
+		return a.raw, func() {}, nil
+	}
+
+	src, err := os.Open(loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+
+	raw, err := ioutil.TempFile(dir, ".kaf-raw-")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Remove(raw.Name())
+	if _, err := io.Copy(raw, zr); err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	closeOldestRaw(msglog)
+	a.raw, a.rawUsed = raw, time.Now()
+	return raw, func() {}, nil
+}
+
+func closeOldestRaw(msglog *msgLog) {
+	var open []*archived
+	for _, a := range msglog.archives {
+		if a.raw != nil {
+			open = append(open, a)
+		}
+	}
+	if len(open) < MaxRawArchives {
+		return
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].rawUsed.Before(open[j].rawUsed)
+	})
+	for _, a := range open[:len(open)-MaxRawArchives+1] {
+		a.closeRaw()
+	}
+}
+
+func (a *archived) closeRaw() {
+	if a.raw != nil {
+		a.raw.Close()
+		a.raw = nil
+	}
+}
+
+/*    way/
+ * index every archive of the log and list them with the messages each
+ * has (not keeping compressed archives we only needed to index). We
+ * always look for them afresh in case they have been changed by hand.
+ */
+func list_(msglog *msgLog) listReqResp {
+	msglog.archList = nil
+	as, err := listArchives(msglog)
+	if err != nil {
+		msglog.errCount++
+		return listReqResp{nil, err}
+	}
+
+	infos := []archiveInfo{}
+	for _, a := range as {
+		info := archiveInfo{
+			Name:       a.fname,
+			At:         a.t.UTC().Format(time.RFC3339),
+			Size:       a.size,
+			Compressed: a.compressed,
+		}
+		if a.msgOs == nil {
+			err := indexArchive(a, msglog)
+			a.closeRaw()
+			if err != nil {
+				msglog.errCount++
+				return listReqResp{nil, err}
+			}
+		}
+		info.Msgs = len(a.msgOs)
+		if len(a.msgOs) > 0 {
+			info.First = a.msgOs[0].num
+			info.Last = a.msgOs[len(a.msgOs)-1].num
+		}
+		infos = append(infos, info)
+	}
+	return listReqResp{infos, nil}
+}
+
+/*    way/
+ * load the offsets of every message in the archive
+ */
+func indexArchive(a *archived, msglog *msgLog) error {
+	f, done, err := openArchive(a, msglog)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.fname, err)
+	}
+	defer done()
+
+	seg := &segment{f: f}
+	hdrEnd, err := loadDBHeader(seg)
+	msgOs := []msgOff{}
+	if err == nil {
+		err = scanSegment(seg, hdrEnd, 0, func(m msg, ord int) bool {
+			msgOs = append(msgOs, msgOff{m.num, m.offset, m.meta.at, seg})
+			return true
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.fname, err)
+	}
+	a.msgOs = msgOs
+	return nil
+}
+
+/*    way/
+ * read messages from the archive starting at the given number - only
+ * those from before the log file (the rest are in the log file)
+ */
+func readArchived(a *archived, num uint64, msglog *msgLog) ([]*msg, error) {
+	ndx := findMsgNdx(a.msgOs, num)
+	if ndx >= len(a.msgOs) || a.msgOs[ndx].num > msglog.start {
+		return nil, nil
+	}
+
+	f, done, err := openArchive(a, msglog)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var msgs []*msg
+	var tot uint64
+	for i := ndx; i < ndx+5 && i < len(a.msgOs); i++ {
+		mo := a.msgOs[i]
+		if mo.num > msglog.start {
+			break
+		}
+		msg, err := readMsg(mo, f)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		tot += msg.sz
+		if tot >= 3200 {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+/*    way/
+ * binary search for first index that matches the number passed in
+ */
+func findMsgNdx(a []msgOff, num uint64) int {
+	if len(a) == 0 {
+		return 0
+	}
+	s := 0
+	e := len(a) - 1
+	for s <= e {
+		if num <= a[s].num {
+			return s
+		}
+		if a[e].num < num {
+			break
+		}
+		m := (s + e) / 2
+		if m == s {
+			return e
+		}
+		if a[m].num < num {
+			s = m
+		} else {
+			e = m
+		}
+	}
+	return len(a)
+}
+
+/*    way/
+ * validate that message header is correct then,
+ * read message data from disk
+ */
+func readMsg(mo msgOff, f *os.File) (*msg, error) {
+
+	msg, err := readRecInfo(mo.offset, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.num == 0 {
+		m := fmt.Sprintf("No message data found at offset %d for msg %d", mo.offset, mo.num)
+		return nil, errors.New(m)
+	}
+
+	if mo.num != msg.num {
+		return nil, errors.New("Message number on disk incorrect")
+	}
+
+	data := make([]byte, msg.sz)
+	_, err = f.ReadAt(data, msg.offset+int64(msg.start))
+	if err != nil {
+		return nil, err
+	}
+	msg.data = data
+
+	return &msg, nil
+}
+
+/*    way/
+ * make sure the message is not a duplicate, that the log is where a
+ * conditional put expects it to be, and that the message fits in the
+ * log's quota. Then read in the message and append it to the end of
+ * the file with the correct record header (KAF|num|sz|meta) - noting
+ * when it arrived in the meta.
+ *
+ *    understand/
+ * we find messages by when they arrived assuming that never goes back
+ * so, if the clock steps back (or a replicated message arrived before
+ * our last message), the message is noted as arriving with our last
+ */
+func put_(req putReq, msglog *msgLog) putReqResp {
+	msglog.putCount++
+
+	data, meta := req.data, req.meta
+
+	if req.num > 0 {
+		if req.num <= msglog.lastmsg {
+			return putReqResp{msglog.lastmsg, errNotExpected, 0}
+		}
+	} else {
+		if len(meta.producer) > 0 {
+			if err := loadKeys(msglog); err != nil {
+				msglog.errCount++
+				return putReqResp{0, err, 0}
+			}
+			if num, err := dedup_(meta, msglog); err != nil {
+				return putReqResp{num, err, 0}
+			}
+		}
+
+		if req.cond && req.expect != msglog.lastmsg {
+			return putReqResp{msglog.lastmsg, errNotExpected, 0}
+		}
+
+		meta.at = time.Now().UnixMilli()
+	}
+	if at := lastAt(msglog); meta.at < at {
+		meta.at = at
+	}
+
+	hdr := recHeader(msglog.lastmsg+1, uint64(len(data)), meta)
+	archived, err := quota_(1, int64(len(hdr)+len(data)), req.quota, msglog)
+	if err != nil {
+		msglog.errCount++
+		return putReqResp{0, err, archived}
+	}
+
+	if shouldRoll(req.roll, msglog) {
+		if err := roll_(msglog); err != nil {
+			msglog.errCount++
+			return putReqResp{0, err, archived}
+		}
+	}
+
+	active := msglog.segs[len(msglog.segs)-1]
+	inf, err := active.f.Stat()
+	if err != nil {
+		msglog.errCount++
+		return putReqResp{0, err, archived}
+	}
+	if active.size != inf.Size() {
+		if !fileExists(msglog.loc) {
+			createLogFile(msglog.loc, msglog.lastmsg)
+		}
+		if err := loadLogFile(msglog); err != nil {
+			return putReqResp{0, err, 0}
+		}
+		active = msglog.segs[len(msglog.segs)-1]
+		inf, err = active.f.Stat()
+		if err != nil {
+			msglog.errCount++
+			return putReqResp{0, err, archived}
+		}
+	}
+	off := inf.Size()
+	num := msglog.lastmsg + 1
+	if req.num > 0 {
+		num = req.num
+	}
+
+	hdr_ := []byte(recHeader(num, uint64(len(data)), meta))
+	if _, err := active.f.WriteAt(hdr_, off); err != nil {
+		msglog.errCount++
+		return putReqResp{0, err, 0}
+	}
+	start := uint64(len(hdr_))
+
+	if _, err := active.f.WriteAt(data, off+int64(start)); err != nil {
+		msglog.errCount++
+		return putReqResp{0, err, 0}
+	}
+
+	if active.n%IndexEvery == 0 {
+		mo := msgOff{num, off, meta.at, active}
+		active.idx = append(active.idx, mo)
+		saveIndex(active, []msgOff{mo}, active.n == 0)
+	}
+	if active.n == 0 {
+		active.at = meta.at
+	}
+	active.n++
+	active.last = num
+	active.lastAt = meta.at
+	active.size += int64(len(data)) + int64(start)
+	if msglog.keys != nil {
+		if len(meta.key) > 0 {
+			msglog.keys[meta.key] = append(msglog.keys[meta.key], num)
+		}
+		if len(meta.producer) > 0 {
+			recordSeq(meta.producer, meta.seq, num, msglog)
+		}
+	}
+	msglog.lastmsg = num
+	msglog.size += int64(len(data)) + int64(start)
+
+	return putReqResp{num, nil, archived}
+}
+
+func lastAt(msglog *msgLog) int64 {
+	for i := len(msglog.segs) - 1; i >= 0; i-- {
+		if seg := msglog.segs[i]; seg.n > 0 {
+			return seg.lastAt
+		}
+	}
+	return 0
+}
+
+/*    way/
+ * check that the transaction's messages will fit in the log's quota
+ * (without archiving - which would happen even if the transaction was
+ * aborted)
+ */
+func prepare_(puts []txnPut, q quota, msglog *msgLog) error {
+	var sz int64
+	for i, p := range puts {
+		p.meta.at = time.Now().UnixMilli()
+		hdr := recHeader(msglog.lastmsg+uint64(i)+1, uint64(len(p.data)), p.meta)
+		sz += int64(len(hdr) + len(p.data))
+	}
+	q.archive = false
+	_, err := quota_(uint64(len(puts)), sz, q, msglog)
+	return err
+}
+
+/*    way/
+ * put each of the transaction's messages (marked with the transaction
+ * intent number). When recovering, first find the transaction's
+ * messages the log already has - they would be at the end of the log,
+ * after the intent was written - and skip those.
+ */
+func commit_(puts []txnPut, roll rolling, cr commitReq, msglog *msgLog) txnPutsResp {
+	var nums []uint64
+	if cr.recover {
+		pos, ok, err := seekMsg(func(mo msgOff) bool { return mo.at >= cr.at }, msglog)
+		for ; ok && err == nil; pos, ok, err = nextMsg(pos, msglog) {
+			if pos.m.meta.txn == cr.id {
+				nums = append(nums, pos.m.num)
+			}
+		}
+		if err != nil {
+			return txnPutsResp{nil, err}
+		}
+	}
+
+	for _, p := range puts[len(nums):] {
+		p.meta.txn = cr.id
+		resp := put_(putReq{data: p.data, meta: p.meta, roll: roll}, msglog)
+		if resp.err != nil {
+			return txnPutsResp{nums, resp.err}
+		}
+		nums = append(nums, resp.num)
+	}
+	return txnPutsResp{nums, nil}
+}
+
+/*    way/
+ * check if we have already seen the producer's sequence number - if we
+ * have the message is a duplicate and we return the number it was
+ * given. A sequence number older than the latest we have seen from the
+ * producer, that we do not remember, is out of order.
+ */
+func dedup_(meta recMeta, msglog *msgLog) (uint64, error) {
+	seqs := msglog.producers[meta.producer]
+	if len(seqs) == 0 || meta.seq > seqs[len(seqs)-1].seq {
+		return 0, nil
+	}
+	for _, sn := range seqs {
+		if sn.seq == meta.seq {
+			return sn.num, errDuplicate
+		}
+	}
+	return seqs[len(seqs)-1].num, errBadSeq
+}
+
+/*    way/
+ * remember the producer's latest few sequence numbers (ignoring any
+ * older than those we already have)
+ */
+func recordSeq(producer string, seq uint64, num uint64, msglog *msgLog) {
+	seqs := msglog.producers[producer]
+	if len(seqs) > 0 && seq <= seqs[len(seqs)-1].seq {
+		return
+	}
+	seqs = append(seqs, seqNum{seq, num})
+	if len(seqs) > ProducerWindow {
+		seqs = seqs[len(seqs)-ProducerWindow:]
+	}
+	msglog.producers[producer] = seqs
+}
+
+/*    way/
+ * check if adding the given number of messages (of the given total
+ * size, including record headers) would take the log over it's quota.
+ * If it would, either reject the messages or roll the log over
+ * (archiving all existing messages) to make room - returning the
+ * message number archived upto.
+ */
+func quota_(n uint64, sz int64, q quota, msglog *msgLog) (uint64, error) {
+	over := func() bool {
+		if q.msgs > 0 && msgCount(msglog)+n > q.msgs {
+			return true
+		}
+		return q.size > 0 && msglog.size+sz > q.size
+	}
+
+	if !over() {
+		return 0, nil
+	}
+	if !q.archive || msgCount(msglog) == 0 {
+		return 0, errLogFull
+	}
+
+	resp := archive_(msglog.lastmsg, q.compress, msglog)
+	if resp.err != nil {
+		return 0, resp.err
+	}
+	if over() {
+		return resp.upto, errLogFull
+	}
+	return resp.upto, nil
+}
+
+/*    understand/
+ * message record headers are of the format:
+ *    KAF_MSG|<num>|<size>|<meta>\n
+ * where meta is a list of name=value fields separated by '&' (any
+ * '%', '&', '=', '|' or control characters in them are %-escaped).
+ * Older records have no meta:
+ *    KAF_MSG|<num>|<size>\n
+ */
+func recHeader(num, sz uint64, meta recMeta) string {
+	m := encodeMeta(meta)
+	if len(m) == 0 {
+		return fmt.Sprintf("%s%d|%d%s", RecHeaderPfx, num, sz, RecHeaderSfx)
+	}
+	return fmt.Sprintf("%s%d|%d|%s%s", RecHeaderPfx, num, sz, m, RecHeaderSfx)
+}
+
+/*    understand/
+ * meta fields:
+ *    at=<arrival time - ISO format with milliseconds>
+ *    key=<message key>
+ *    producer=<producer id>
+ *    seq=<producer sequence number>
+ *    txn=<transaction intent number>
+ *    x-<name>=<user header value>
+ */
+func encodeMeta(meta recMeta) string {
+	var f []string
+	if meta.at != 0 {
+		t := time.UnixMilli(meta.at).UTC().Format(TimeFormat)
+		f = append(f, "at="+escapeMeta(t))
+	}
+	if len(meta.key) > 0 {
+		f = append(f, "key="+escapeMeta(meta.key))
+	}
+	if len(meta.producer) > 0 {
+		f = append(f, "producer="+escapeMeta(meta.producer))
+		f = append(f, "seq="+strconv.FormatUint(meta.seq, 10))
+	}
+	if meta.txn != 0 {
+		f = append(f, "txn="+strconv.FormatUint(meta.txn, 10))
+	}
+	names := make([]string, 0, len(meta.hdrs))
+	for name := range meta.hdrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f = append(f, "x-"+escapeMeta(name)+"="+escapeMeta(meta.hdrs[name]))
+	}
+	return strings.Join(f, "&")
+}
+
+/*    way/
+ * walk the name=value fields, picking up the ones we know about (and
+ * ignoring any others so newer records can still be read)
+ */
+func decodeMeta(m string) (recMeta, error) {
+	var meta recMeta
+	if len(m) == 0 {
+		return meta, nil
+	}
+	for _, f := range strings.Split(m, "&") {
+		k, v, _ := strings.Cut(f, "=")
+		k, err := unescapeMeta(k)
+		if err != nil {
+			return meta, err
+		}
+		v, err = unescapeMeta(v)
+		if err != nil {
+			return meta, err
+		}
+		switch k {
+		case "at":
+			t, err := time.Parse(TimeFormat, v)
+			if err != nil {
+				return meta, errors.New("invalid record header time")
+			}
+			meta.at = t.UnixMilli()
+		case "key":
+			meta.key = v
+		case "producer":
+			meta.producer = v
+		case "seq":
+			meta.seq, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return meta, errors.New("invalid record header sequence number")
+			}
+		case "txn":
+			txn, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return meta, errors.New("invalid record header transaction")
+			}
+			meta.txn = txn
+		default:
+			if strings.HasPrefix(k, "x-") && len(k) > 2 {
+				if meta.hdrs == nil {
+					meta.hdrs = map[string]string{}
+				}
+				meta.hdrs[k[2:]] = v
+			}
+		}
+	}
+	return meta, nil
+}
+
+func escapeMeta(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < 0x20 || c == 0x7f || c == '%' || c == '&' || c == '=' || c == '|' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeMeta(v string) (string, error) {
+	if strings.IndexByte(v, '%') == -1 {
+		return v, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '%' {
+			b.WriteByte(v[i])
+			continue
+		}
+		if i+2 >= len(v) {
+			return "", errors.New("invalid record header meta escape")
+		}
+		c, err := strconv.ParseUint(v[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("invalid record header meta escape")
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+/*    outcome/
+ * clear any existing data, (re)-open the log's segments (the rolled
+ * over segments in order and then the log file itself), read in their
+ * headers and indexes and repopulate the msglog
+ *
+ *    understand/
+ * if we stopped in the middle of rolling over a segment, the last
+ * rolled over segment and the log file will both start after the same
+ * message (see roll_) - the log file has the messages so we remove the
+ * other
+ */
+func loadLogFile(msglog *msgLog) error {
+	clearMsgLog(msglog)
+
+	locs, err := segmentLocs(msglog)
+	if err != nil {
+		return err
+	}
+	locs = append(locs, msglog.loc)
+
+	var segs []*segment
+	var hdrEnds []int64
+	for _, loc := range locs {
+		seg, hdrEnd, err := openSegment(loc)
+		if err != nil {
+			closeSegments(segs)
+			return err
+		}
+		segs = append(segs, seg)
+		hdrEnds = append(hdrEnds, hdrEnd)
+	}
+
+	if l := len(segs); l > 1 && segs[l-2].start == segs[l-1].start {
+		segs[l-2].f.Close()
+		os.Remove(idxLoc(segs[l-2].loc))
+		if err := os.Remove(segs[l-2].loc); err != nil {
+			closeSegments(segs)
+			return err
+		}
+		segs = append(segs[:l-2], segs[l-1])
+		hdrEnds = append(hdrEnds[:l-2], hdrEnds[l-1])
+	}
+
+	msglog.segs = segs
+	msglog.start = segs[0].start
+	for i, seg := range segs {
+		if seg.start < msglog.lastmsg {
+			return fmt.Errorf("%s: segment starts before the last message (%d < %d)", filepath.Base(seg.loc), seg.start, msglog.lastmsg)
+		}
+		msglog.lastmsg = seg.start
+		if err := loadIndex(hdrEnds[i], seg, msglog); err != nil {
+			return err
+		}
+		msglog.size += seg.size
+	}
+
+	return nil
+}
+
+/*    way/
+ * find the rolled over segments of the log, in order
+ */
+func segmentLocs(msglog *msgLog) ([]string, error) {
+	dir := filepath.Dir(msglog.loc)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pfx := "--" + msglog.name + "--" + SegmentPfx
+	var locs []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), pfx) {
+			locs = append(locs, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(locs)
+	return locs, nil
+}
+
+/*    understand/
+ * segments are named by the (zero-padded) message number they start
+ * after so they sort in order
+ */
+func segmentLoc(msglog *msgLog, start uint64) string {
+	fname := fmt.Sprintf("--%s--%s%020d", msglog.name, SegmentPfx, start)
+	return filepath.Join(filepath.Dir(msglog.loc), fname)
+}
+
+/*    way/
+ * open the segment file and read it's header
+ */
+func openSegment(loc string) (*segment, int64, error) {
+	f, err := os.OpenFile(loc, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	seg := &segment{loc: loc, f: f}
+	hdrEnd, err := loadDBHeader(seg)
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s: %s", filepath.Base(loc), err)
+	}
+	return seg, hdrEnd, nil
+}
+
+/*    way/
+ * get the size of the segment and read in it's header
+ */
+func loadDBHeader(seg *segment) (int64, error) {
+	inf, err := seg.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	seg.size = inf.Size()
+
+	const BIGENOUGH = 32
+	hdr := make([]byte, BIGENOUGH)
+	n, err := seg.f.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	start, hdrEnd, err := parseDBHeader(hdr[:n])
+	if err != nil {
+		return 0, err
+	}
+	seg.start = start
+	return hdrEnd, nil
+}
+
+func closeSegments(segs []*segment) {
+	for _, seg := range segs {
+		seg.f.Close()
+	}
+}
+
+/*    understand/
+ * producer sequence numbers are kept across reloads (archival,
+ * compaction) so messages that are no longer in the log file are still
+ * not duplicated. Keys are reloaded when next needed.
+ */
+func clearMsgLog(msglog *msgLog) {
+	closeSegments(msglog.segs)
+	msglog.segs = nil
+	msglog.size = 0
+	msglog.start = 0
+	msglog.lastmsg = 0
+	msglog.keys = nil
+	if msglog.producers == nil {
+		msglog.producers = map[string][]seqNum{}
+	}
+}
+
+/*    outcome/
+ * validate the first part of the header (fixed part), then read in the
+ * last message number (and where the header ends)
+ */
+func parseDBHeader(hdr []byte) (uint64, int64, error) {
+	n := len(hdr)
+	l := len(DBHeader)
+
+	if n < l || bytes.Compare([]byte(DBHeader), hdr[:l]) != 0 {
+		return 0, 0, errors.New("invalid db header")
+	}
+
+	e := l
+	for e < n {
+		e++
+		if e == n || hdr[e] == '\n' {
+			break
+		}
+	}
+
+	lastmsg, err := strconv.ParseUint(string(hdr[l:e]), 10, 64)
+	if err != nil {
+		m := fmt.Sprintf("bad last message number: %s", hdr[l:e])
+		return 0, 0, errors.New(m)
+	}
+
+	return lastmsg, int64(e), nil
+}
+
+/*    way/
+ * find the last message of a log that isn't open - it's log file's
+ * header holds the message it starts after, and the index gets us near
+ * it's end, so we only need to step through the records after that
+ */
+func peekLast(loc string) (uint64, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	seg := &segment{loc: loc, f: f}
+	hdrEnd, err := loadDBHeader(seg)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", filepath.Base(loc), err)
+	}
+
+	last, off := seg.start, hdrEnd
+	idx, ok := readIndex(hdrEnd, seg, &msgLog{lastmsg: seg.start})
+	if l := len(idx); ok && l > 0 {
+		off = idx[l-1].offset
+	}
+	err = scanSegment(seg, off, 0, func(m msg, ord int) bool {
+		last = m.num
+		return true
+	})
+	return last, err
+}
+
+/*    understand/
+ * each segment has an index file next to it (.<segment file>.idx)
+ * holding the offset of every IndexEvery'th message in the segment:
+ *    KAF_IDX|v1|<segment start>|<every>\n
+ *    <num>|<offset>|<at>\n
+ *    ...
+ * It is appended to as messages are added and is only ever a shortcut
+ * - when loading we check it against the segment and rebuild it if it
+ * does not match.
+ */
+func idxLoc(loc string) string {
+	return filepath.Join(filepath.Dir(loc), "."+filepath.Base(loc)+".idx")
+}
+
+/*    way/
+ * read in the segment's index and, if it matches the segment, step
+ * through the messages from the last indexed message on - indexing any
+ * new ones. If it does not match, step through the whole segment and
+ * write the index afresh.
+ */
+func loadIndex(hdrEnd int64, seg *segment, msglog *msgLog) error {
+	idx, ok := readIndex(hdrEnd, seg, msglog)
+	l := len(idx)
+	off, ord := hdrEnd, 0
+	if l > 0 {
+		off, ord = idx[l-1].offset, (l-1)*IndexEvery
+		if l > 1 {
+			msglog.lastmsg = idx[l-2].num
+		}
+		seg.idx = idx[:l-1]
+	}
+
+	var err_ error
+	err := scanSegment(seg, off, ord, func(m msg, ord int) bool {
+		if m.num <= msglog.lastmsg {
+			err_ = fmt.Errorf("message number did not increase (%d !< %d)", msglog.lastmsg, m.num)
+			return false
+		}
+		msglog.lastmsg = m.num
+		if ord%IndexEvery == 0 {
+			seg.idx = append(seg.idx, msgOff{m.num, m.offset, m.meta.at, seg})
+		}
+		seg.n = ord + 1
+		seg.last = m.num
+		seg.lastAt = m.meta.at
+		return true
+	})
+	if err == nil {
+		err = err_
+	}
+	if err != nil {
+		return err
+	}
+	if seg.n > 0 {
+		seg.at = seg.idx[0].at
+	}
+
+	if !ok {
+		saveIndex(seg, seg.idx, true)
+	} else if len(seg.idx) > l {
+		saveIndex(seg, seg.idx[l:], false)
+	}
+	return nil
+}
+
+/*    way/
+ * read in the segment's index, checking that it is for the segment,
+ * that it's entries are in order and within the segment, that it's
+ * first entry is the segment's first message, and that it's last entry
+ * is the message it should be
+ */
+func readIndex(hdrEnd int64, seg *segment, msglog *msgLog) ([]msgOff, bool) {
+	data, err := ioutil.ReadFile(idxLoc(seg.loc))
+	if err != nil {
+		return nil, false
+	}
+	lines := strings.Split(string(data), "\n")
+	if lines[0] != fmt.Sprintf("%s%d|%d", IdxHeader, seg.start, IndexEvery) {
+		return nil, false
+	}
+	if len(lines[len(lines)-1]) != 0 {
+		return nil, false
+	}
+
+	var idx []msgOff
+	lastnum, lastoff := msglog.lastmsg, hdrEnd-1
+	for _, line := range lines[1 : len(lines)-1] {
+		f := strings.Split(line, "|")
+		if len(f) != 3 {
+			return nil, false
+		}
+		num, err1 := strconv.ParseUint(f[0], 10, 64)
+		off, err2 := strconv.ParseInt(f[1], 10, 64)
+		at, err3 := strconv.ParseInt(f[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, false
+		}
+		if num <= lastnum || off <= lastoff || off >= seg.size {
+			return nil, false
+		}
+		idx = append(idx, msgOff{num, off, at, seg})
+		lastnum, lastoff = num, off
+	}
+	if len(idx) == 0 {
+		return idx, true
+	}
+
+	var first int64 = -1
+	err = scanSegment(seg, hdrEnd, 0, func(m msg, ord int) bool {
+		first = m.offset
+		return false
+	})
+	if err != nil || first != idx[0].offset {
+		return nil, false
+	}
+	last := idx[len(idx)-1]
+	m, err := readRecInfo(last.offset, seg.f)
+	if err != nil || m.num != last.num || m.meta.at != last.at {
+		return nil, false
+	}
+	return idx, true
+}
+
+/*    way/
+ * save the entries to the segment's index file. If that fails, the file
+ * no longer has every entry - and as loading only checks it's first and
+ * last entries, a gap would go unnoticed and throw off the position of
+ * every message after it. So we remove the file and stop saving to it,
+ * leaving it to be rebuilt when the segment is next loaded.
+ */
+func saveIndex(seg *segment, idx []msgOff, fresh bool) {
+	if seg.noIdx {
+		return
+	}
+	if err := writeIndex(seg, idx, fresh); err != nil {
+		log.Println("index:", err)
+		seg.noIdx = true
+		os.Remove(idxLoc(seg.loc))
+	}
+}
+
+/*    way/
+ * append the entries to the segment's index (or write it afresh with
+ * it's header)
+ */
+func writeIndex(seg *segment, idx []msgOff, fresh bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if fresh {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(idxLoc(seg.loc), flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if fresh {
+		fmt.Fprintf(&b, "%s%d|%d\n", IdxHeader, seg.start, IndexEvery)
+	}
+	for _, mo := range idx {
+		fmt.Fprintf(&b, "%d|%d|%d\n", mo.num, mo.offset, mo.at)
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/*    way/
+ * step through the segment's records from the offset (which is at the
+ * given position in the segment), passing each message to fn till it
+ * returns false
+ */
+func scanSegment(seg *segment, off int64, ord int, fn func(m msg, ord int) bool) error {
+	for off < seg.size {
+		m, err := readRecInfo(off, seg.f)
+		if err != nil {
+			return err
+		}
+		if m.num > 0 {
+			if !fn(m, ord) {
+				return nil
+			}
+			ord++
+		}
+		off = m.offset + int64(m.start+m.sz)
+	}
+	return nil
+}
+
+/*    way/
+ * find the first message in the log for which `reached` is true (it
+ * must stay true for every later message) - skipping segments whose last
+ * message has not reached it
+ */
+func seekMsg(reached func(mo msgOff) bool, msglog *msgLog) (msgPos, bool, error) {
+	for si, seg := range msglog.segs {
+		if seg.n == 0 || !reached(msgOff{num: seg.last, at: seg.lastAt, seg: seg}) {
+			continue
+		}
+		return seekSeg(si, reached, msglog)
+	}
+	return msgPos{}, false, nil
+}
+
+/*    way/
+ * find the first message in the segment for which `reached` is true -
+ * searching the index for the last indexed message before it and then
+ * stepping through the records from there
+ */
+func seekSeg(si int, reached func(mo msgOff) bool, msglog *msgLog) (msgPos, bool, error) {
+	seg := msglog.segs[si]
+	if seg.n == 0 {
+		return msgPos{}, false, nil
+	}
+	i := sort.Search(len(seg.idx), func(i int) bool {
+		return reached(seg.idx[i])
+	})
+	if i > 0 {
+		i--
+	}
+
+	var pos msgPos
+	found := false
+	err := scanSegment(seg, seg.idx[i].offset, i*IndexEvery, func(m msg, ord int) bool {
+		if reached(msgOff{m.num, m.offset, m.meta.at, seg}) {
+			pos, found = msgPos{m, si, ord}, true
+			return false
+		}
+		return true
+	})
+	return pos, found, err
+}
+
+/*    way/
+ * find the message at the given position in the log (counting from
+ * zero) - going straight to it's nearest indexed message
+ */
+func seekOrd(ord int, msglog *msgLog) (msgPos, bool, error) {
+	for si, seg := range msglog.segs {
+		if ord >= seg.n {
+			ord -= seg.n
+			continue
+		}
+		i := ord / IndexEvery
+
+		var pos msgPos
+		found := false
+		err := scanSegment(seg, seg.idx[i].offset, i*IndexEvery, func(m msg, o int) bool {
+			if o == ord {
+				pos, found = msgPos{m, si, o}, true
+				return false
+			}
+			return true
+		})
+		return pos, found, err
+	}
+	return msgPos{}, false, nil
+}
+
+/*    way/
+ * find the message after the given one - the next in it's segment or
+ * the first of the next segment that has messages
+ */
+func nextMsg(pos msgPos, msglog *msgLog) (msgPos, bool, error) {
+	seg := msglog.segs[pos.si]
+	if pos.ord+1 < seg.n {
+		var next msgPos
+		found := false
+		off := pos.m.offset + int64(pos.m.start+pos.m.sz)
+		err := scanSegment(seg, off, pos.ord+1, func(m msg, ord int) bool {
+			next, found = msgPos{m, pos.si, ord}, true
+			return false
+		})
+		return next, found, err
+	}
+
+	for si := pos.si + 1; si < len(msglog.segs); si++ {
+		seg := msglog.segs[si]
+		if seg.n > 0 {
+			m, err := readRecInfo(seg.idx[0].offset, seg.f)
+			return msgPos{m, si, 0}, err == nil, err
+		}
+	}
+	return msgPos{}, false, nil
+}
+
+func msgCount(msglog *msgLog) uint64 {
+	var n int
+	for _, seg := range msglog.segs {
+		n += seg.n
+	}
+	return uint64(n)
+}
+
+/*    way/
+ * if we haven't already, step through every message in the log,
+ * loading the messages of each key and the sequence numbers of each
+ * producer
+ */
+func loadKeys(msglog *msgLog) error {
+	if msglog.keys != nil {
+		return nil
+	}
+
+	keys := map[string][]uint64{}
+	for _, seg := range msglog.segs {
+		if seg.n == 0 {
+			continue
+		}
+		err := scanSegment(seg, seg.idx[0].offset, 0, func(m msg, ord int) bool {
+			if len(m.meta.key) > 0 {
+				keys[m.meta.key] = append(keys[m.meta.key], m.num)
+			}
+			if len(m.meta.producer) > 0 {
+				recordSeq(m.meta.producer, m.meta.seq, m.num, msglog)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	msglog.keys = keys
+	return nil
+}
+
+/*    way/
+ * read a chunk of data from the offset that should be big enough to
+ * hold the header (marked off by the newline) and return the message
+ * info from the header.
+ *
+ *    understand/
+ * message header is of the format:
+ *    KAF|<string number>|<string size>|<meta>\n
+ * (see recHeader)
+ */
+func readRecInfo(off int64, f *os.File) (msg, error) {
+	pos := struct {
+		curr          int
+		headerStart   int
+		firstDivider  int
+		secondDivider int
+		thirdDivider  int
+		headerEnd     int
+	}{0, -1, -1, -1, -1, -1}
+
+	hdr, err := readRecHeader(off, f)
+	if err != nil {
+		return msg{}, err
+	}
+	n := len(hdr)
+
+	if n == 0 {
+		m := fmt.Sprintf("read at offset %d failed", off)
+		return msg{}, errors.New(m)
+	}
+
+	for ; pos.curr < n; pos.curr++ {
+		if hdr[pos.curr] != '\n' {
+			break
+		}
+	}
+
+	if pos.curr == 0 {
+		return msg{}, errors.New("invalid record header start")
+	}
+
+	if pos.curr == n {
+		return msg{
+			offset: off,
+			start:  uint64(n),
+			num:    0,
+			sz:     0,
+			data:   nil,
+		}, nil
+	}
+
+	pos.headerStart = pos.curr - 1
+
+	for ; pos.curr < n; pos.curr++ {
+		if hdr[pos.curr] == '|' {
+			if pos.firstDivider == -1 {
+				pos.firstDivider = pos.curr
+			} else if pos.secondDivider == -1 {
+				pos.secondDivider = pos.curr
+			} else if pos.thirdDivider == -1 {
+				pos.thirdDivider = pos.curr
+			} else {
+				return msg{}, errors.New("invalid record header: extra '|' found")
+			}
+		}
+		if hdr[pos.curr] == []byte(RecHeaderSfx)[0] {
+			pos.headerEnd = pos.curr
+			break
+		}
+	}
+
+	rechdr := hdr[pos.headerStart : pos.firstDivider+1]
+	if bytes.Compare(rechdr, []byte(RecHeaderPfx)) != 0 {
+		return msg{}, errors.New("invalid record header prefix")
+	}
+
+	if pos.firstDivider == -1 {
+		return msg{}, errors.New("invalid record header: no number")
+	}
+
+	if pos.secondDivider == -1 {
+		return msg{}, errors.New("invalid record header: no size")
+	}
+
+	if pos.headerEnd == -1 {
+		return msg{}, errors.New("invalid record header: not terminated correctly")
+	}
+
+	v := string(hdr[pos.firstDivider+1 : pos.secondDivider])
+	num, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return msg{}, errors.New("invalid record header message number")
+	}
+	szEnd := pos.headerEnd
+	if pos.thirdDivider != -1 {
+		szEnd = pos.thirdDivider
+	}
+	v = string(hdr[pos.secondDivider+1 : szEnd])
+	sz, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return msg{}, errors.New("invalid record header message size")
+	}
+	var meta recMeta
+	if pos.thirdDivider != -1 {
+		meta, err = decodeMeta(string(hdr[pos.thirdDivider+1 : pos.headerEnd]))
+		if err != nil {
+			return msg{}, err
+		}
+	}
+
+	return msg{
+		offset: off,
+		start:  uint64(pos.headerEnd + 1),
+		num:    num,
+		sz:     sz,
+		meta:   meta,
+		data:   nil,
+	}, nil
+
+}
+
+/*    way/
+ * read from the offset, doubling the amount we read till we have the
+ * whole header (the line after any leading newlines) or have reached
+ * the maximum header size or the end of the file
+ */
+func readRecHeader(off int64, f *os.File) ([]byte, error) {
+	sz := 64
+	for {
+		hdr := make([]byte, sz)
+		n, err := f.ReadAt(hdr, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		hdr = hdr[:n]
+
+		s := 0
+		for s < n && hdr[s] == '\n' {
+			s++
+		}
+		if n < sz || sz >= MaxRecHeader || bytes.IndexByte(hdr[s:], '\n') != -1 {
+			return hdr, nil
+		}
+		sz *= 2
+	}
+}
+
+/*    way/
+ * setup the server with the correct configuration and handlers and
+ * start it up
+ */
+func startServer(cfgs *atomic.Pointer[config], logsR logsRoutine, lim limiter) {
+	cfg := cfgs.Load()
+
+	s := &http.Server{
+		Addr:           cfg.addr,
+		Handler:        requestHandlers(cfgs, logsR, lim),
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+		MaxHeaderBytes: 4096,
+	}
+
+	log.Println("Starting server on", cfg.addr, "writing to", cfg.dbloc)
+	log.Fatal(s.ListenAndServe())
+}
+
+/*    way/
+ * return a mux with our request handlers, each getting the current
+ * config and only being called if the request is allowed
+ */
+func requestHandlers(cfgs *atomic.Pointer[config], lr logsRoutine, lim limiter) *http.ServeMux {
+	wrapH := func(h reqHandler) httpHandler {
+		return func(w http.ResponseWriter, r *http.Request) {
+			cfg := cfgs.Load()
+			if allowed(cfg, r, lr, lim, w) && !renamed(cfg, r, lr, w) && !readOnly(cfg, r, lr, w) {
+				h(cfg, r, lr, w)
+			}
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get/", wrapH(get))
+	mux.HandleFunc("/put/", wrapH(put))
+	mux.HandleFunc("/archive/", wrapH(archive))
+	mux.HandleFunc("/compact/", wrapH(compact))
+	mux.HandleFunc("/archives/", wrapH(archives))
+	mux.HandleFunc("/log/", wrapH(logH))
+	mux.HandleFunc("/txn/", wrapH(txn))
+	mux.HandleFunc("/commit/", wrapH(commit))
+	mux.HandleFunc("/lease/", wrapH(lease))
+	mux.HandleFunc("/ack/", wrapH(ack))
+	mux.HandleFunc("/stats", wrapH(logStats))
+	mux.HandleFunc("/stats/", wrapH(logStats))
+	mux.HandleFunc("/promote", wrapH(promote))
+	return mux
+}
+
+/*    way/
+ * helper function that finds the given log in the registry or, if it
+ * isn't open, requests logsRoutine for it
+ */
+func getLog(name string, logsR logsRoutine, create bool) (*logRoutine, error) {
+	if logR := logsR.reg.find(name); logR != nil {
+		return logR, nil
+	}
+	c := make(chan logReqResp)
+	logsR.c <- logReq{
+		name:   name,
+		create: create,
+		resp:   c,
+	}
+	resp := <-c
+	return resp.logR, resp.err
+}
+
+/*    way/
+ * helper function that appends data to the given log (creating it if
+ * needed) and returns the new message number
+ */
+func putLog(name string, data []byte, logsR logsRoutine) (uint64, error) {
+	logR, err := getLog(name, logsR, true)
+	if err != nil {
+		return 0, err
+	}
+	c := make(chan putReqResp)
+	if err := send(logR, logR.put, putReq{data: data, resp: c}); err != nil {
+		return 0, err
+	}
+	resp := <-c
+	return resp.num, resp.err
+}
+
+/*    way/
+ * helper function that gets the current stats of the given log without
+ * resetting it's counts
+ */
+func peekStats(logR *logRoutine) (stats, error) {
+	c := make(chan stats)
+	if err := send(logR, logR.stat, statReq{peek: true, resp: c}); err != nil {
+		return stats{}, err
+	}
+	return <-c, nil
+}
+
+/*    way/
+ * helper functions that request the consumers goroutine to commit an
+ * offset, for the offset a consumer has committed, or for all committed
+ * offsets
+ */
+func commitOffset(name, consumer string, upto uint64, logsR logsRoutine) error {
+	c := make(chan offsetReqResp)
+	logsR.o <- offsetReq{
+		log:      name,
+		consumer: consumer,
+		upto:     upto,
+		commit:   true,
+		resp:     c,
+	}
+	return (<-c).err
+}
+
+func getOffset(name, consumer string, logsR logsRoutine) (uint64, bool) {
+	c := make(chan offsetReqResp)
+	logsR.o <- offsetReq{
+		log:      name,
+		consumer: consumer,
+		resp:     c,
+	}
+	resp := <-c
+	return resp.upto, resp.ok
+}
+
+func getOffsets(logsR logsRoutine) map[string]map[string]uint64 {
+	c := make(chan offsetReqResp)
+	logsR.o <- offsetReq{all: true, resp: c}
+	return (<-c).offsets
+}
+
+/*    way/
+ * record an administrative operation in the audit log. Operations kaf
+ * performs on it's own (without a request) are recorded as done by
+ * "kaf".
+ */
+func audit(cfg *config, logsR logsRoutine, op string, r *http.Request, params map[string]string, err error) {
+	ev := auditEvent{
+		At:     time.Now().UTC().Format(time.RFC3339Nano),
+		Op:     op,
+		Who:    "kaf",
+		Params: params,
+		Result: "ok",
+	}
+	if r != nil {
+		ev.Who, _ = requester(cfg, r)
+		ev.Addr = r.RemoteAddr
+	}
+	if err != nil {
+		ev.Result = err.Error()
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Println("audit:", err)
+		return
+	}
+	if _, err := putLog(AuditLog, data, logsR); err != nil {
+		log.Println("audit:", err)
+	}
+}
+
+/*    understand/
+ * the identity of whoever made the request - the name of the token
+ * they presented (Authorization: Bearer <token>) or, without a token,
+ * their IP address. An unknown token is an error.
+ */
+func requester(cfg *config, r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) == 0 {
+		return host, nil
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return host, errors.New("unsupported authorization")
+	}
+	name, ok := cfg.tokens[strings.TrimSpace(auth[len("Bearer "):])]
+	if !ok {
+		return host, errors.New("invalid token")
+	}
+	return name, nil
+}
+
+/*    understand/
+ * admins are clients with a token whose name is in the admin setting
+ */
+func isAdmin(cfg *config, r *http.Request) bool {
+	if len(r.Header.Get("Authorization")) == 0 {
+		return false
+	}
+	who, err := requester(cfg, r)
+	return err == nil && cfg.admins[who]
+}
+
+/*    way/
+ * if the log asked for has been renamed, either redirect the client to
+ * the new name (if so configured) or tell them it was renamed. Admins
+ * managing logs (under /log/) get the renamed log itself.
+ */
+func renamed(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) bool {
+	if strings.HasPrefix(r.URL.Path, "/log/") {
+		return false
+	}
+	name := logName(r)
+	to, ok := logsR.reg.renamedTo(name)
+	if !ok {
+		return false
+	}
+	if cfg.redirect {
+		u := *r.URL
+		u.Path = u.Path[:strings.IndexByte(u.Path[1:], '/')+2] + to
+		http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+		return true
+	}
+	err_(renamedErr{to}.Error(), 410, r, w)
+	return true
+}
+
+/*    way/
+ * followers only serve reads (and promotion) - telling clients to send
+ * anything else to the leader
+ */
+func readOnly(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) bool {
+	if !following(cfg, logsR) || r.URL.Path == "/promote" {
+		return false
+	}
+	if r.Method == "GET" {
+		for _, pfx := range []string{"/get/", "/stats", "/archives/"} {
+			if strings.HasPrefix(r.URL.Path, pfx) {
+				return false
+			}
+		}
+	}
+	err_(errFollower.Error()+" ("+cfg.follow+")", 403, r, w)
+	return true
+}
+
+/*    way/
+ * check the requester's token (if any) and that the requester and the
+ * log are within their rate limits - responding with an error if not.
+ * Failed attempts are limited by host before we audit them so they
+ * can't flood the audit log.
+ */
+func allowed(cfg *config, r *http.Request, logsR logsRoutine, lim limiter, w http.ResponseWriter) bool {
+	who, err := requester(cfg, r)
+	if err != nil {
+		wait := lim.take("auth|"+who, "", 0, limits{rps: AuthFailRPS}, limits{})
+		if wait > 0 {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Add("Retry-After", strconv.Itoa(secs))
+			err_("too many requests", 429, r, w)
+			return false
+		}
+		audit(cfg, logsR, "auth", r, map[string]string{"path": r.URL.Path}, err)
+		err_(err.Error(), 401, r, w)
+		return false
+	}
+
+	name := logName(r)
+	var sz int64
+	if r.ContentLength > 0 {
+		sz = r.ContentLength
+	}
+	wait := lim.take(who, name, sz, cfg.client, cfg.logCfg(name).limits)
+	if wait > 0 {
+		secs := int(math.Ceil(wait.Seconds()))
+		w.Header().Add("Retry-After", strconv.Itoa(secs))
+		err_("too many requests", 429, r, w)
+		return false
+	}
+
+	return true
+}
+
+/*    understand/
+ * requests are of the form /<op>/<logname> so the log name is whatever
+ * follows the second '/'
+ */
+func logName(r *http.Request) string {
+	p := r.URL.Path
+	if len(p) < 1 {
+		return ""
+	}
+	i := strings.IndexByte(p[1:], '/')
+	if i == -1 {
+		return ""
+	}
+	return strings.TrimSpace(p[i+2:])
+}
+
+/*    way/
+ * handle /get/<logname>?from=num&format=[kaf|raw|json]&meta=[true|false]
+ * request, responding with messages from the event log. Instead of
+ * from=num, since=<ISO time> gets messages from the first message that
+ * arrived at or after that time. key=<key> gets only messages with that
+ * key - just the latest one unless from=num is also given.
+ * from=committed&consumer=<name> gets messages after the offset the
+ * consumer last committed (from the start if it hasn't committed).
+ * If the log is configured to read archives, messages from before the
+ * log file are read from them.
+ */
+func get(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/get/"):])
+	if isHidden(name) {
+		err_("get: invalid log name", 400, r, w)
+		return
+	}
+
+	var num uint64
+	var since int64
+	qv := r.URL.Query()["from"]
+	sv := r.URL.Query()["since"]
+	key := r.URL.Query().Get("key")
+	if len(qv) > 0 && len(sv) > 0 {
+		err_("get: Use either 'from' or 'since'", 400, r, w)
+		return
+	}
+	if len(key) > 0 && len(sv) > 0 {
+		err_("get: Cannot use 'since' with 'key'", 400, r, w)
+		return
+	}
+	if len(sv) > 0 {
+		t, err := time.Parse(time.RFC3339Nano, sv[0])
+		if err != nil {
+			err_("get: Invalid 'since' time", 400, r, w)
+			return
+		}
+		since = t.UnixMilli()
+	} else if len(qv) > 0 && qv[0] == "committed" {
+		consumer := r.URL.Query().Get("consumer")
+		if len(consumer) == 0 {
+			err_("get: Missing 'consumer' for committed offset", 400, r, w)
+			return
+		}
+		upto, _ := getOffset(name, consumer, logsR)
+		w.Header().Add("X-Kaf-Committed", strconv.FormatUint(upto, 10))
+		num = upto + 1
+	} else if len(key) == 0 || len(qv) > 0 {
+		if qv == nil || len(qv) == 0 {
+			err_("get: Missing 'from' message number", 400, r, w)
+			return
+		}
+		var err error
+		num, err = strconv.ParseUint(qv[0], 10, 64)
+		if err != nil || num < 1 {
+			err_("get: Invalid 'from' message number", 400, r, w)
+			return
+		}
+	}
+
+	logR, err := getLog(name, logsR, false)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
+	}
+
+	var msgs []*msg
+	if logR != nil {
+		c := make(chan getReqResp)
+		err := send(logR, logR.get, getReq{
+			num:      num,
+			since:    since,
+			key:      key,
+			archived: cfg.logCfg(name).readArchives,
+			resp:     c,
+		})
+		if err != nil {
+			err_(err.Error(), 503, r, w)
+			return
+		}
+		resp := <-c
+		if resp.err != nil {
+			err_(resp.err.Error(), 500, r, w)
+			return
+		}
+		msgs = resp.msgs
+	}
+
+	respondMsgs(msgs, r, w)
+}
+
+/*    way/
+ * respond with the messages in the format asked for (kaf if not given)
+ * along with the number of the last message sent and when it arrived
+ */
+func respondMsgs(msgs []*msg, r *http.Request, w http.ResponseWriter) {
+	if len(msgs) > 0 {
+		last := msgs[len(msgs)-1]
+		w.Header().Add("X-Kaf-LastMsgSent", strconv.FormatUint(last.num, 10))
+		if last.meta.at != 0 {
+			at := time.UnixMilli(last.meta.at).UTC().Format(TimeFormat)
+			w.Header().Add("X-Kaf-LastMsgAt", at)
+		}
+	}
+
+	format := "kaf"
+	qv := r.URL.Query()["format"]
+	if len(qv) > 0 {
+		format = qv[0]
+	}
+	withMeta, _ := strconv.ParseBool(r.URL.Query().Get("meta"))
+	switch format {
+	case "raw":
+		rawFormat(msgs, withMeta, r, w)
+	case "json":
+		jsonFormat(msgs, withMeta, r, w)
+	default:
+		kafFormat(msgs, withMeta, r, w)
+	}
+}
+
+/*    way/
+ * respond in kaf format - with headers and data - setting the content
+ * type and content length for efficiency. Message headers only carry
+ * the meta when asked for (withMeta) so existing clients still get
+ * the KAF_MSG|<num>|<size> headers they expect.
+ */
+func kafFormat(msgs []*msg, withMeta bool, r *http.Request, w http.ResponseWriter) {
+	respHdr := fmt.Sprintf("%s|%d", RespHeaderPfx, len(msgs))
+	respSz := len(respHdr)
+	msgHdrs := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		meta := recMeta{}
+		if withMeta {
+			meta = m.meta
+		}
+		msgHdrs[i] = []byte(recHeader(m.num, m.sz, meta))
+		respSz += len(msgHdrs[i])
+		respSz += len(m.data)
+	}
+
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Length", strconv.FormatUint(uint64(respSz), 10))
+
+	if _, err := w.Write([]byte(respHdr)); err != nil {
+		err_("get: failed sending data back", 500, r, w)
+		return
+	}
+	for i, m := range msgs {
+		hdr := msgHdrs[i]
+		if _, err := w.Write([]byte(hdr)); err != nil {
+			err_("get: failed sending data back", 500, r, w)
+			return
+		}
+		if _, err := w.Write(m.data); err != nil {
+			err_("get: failed sending data back", 500, r, w)
+			return
+		}
+	}
+}
+
+/*    way/
+ * respond in raw format - just data without headers - setting the content
+ * type and content length for efficiency. If asked for (withMeta), the
+ * metadata of each message is sent in an X-Kaf-MsgMeta response header
+ * (<num>|<meta>) - not X-Kaf-Meta-, which is for user metadata on put.
+ */
+func rawFormat(msgs []*msg, withMeta bool, r *http.Request, w http.ResponseWriter) {
+
+	respSz := 0
+	for _, m := range msgs {
+		respSz += len(m.data)
+		respSz += len("\n")
+		if withMeta {
+			meta := fmt.Sprintf("%d|%s", m.num, encodeMeta(m.meta))
+			w.Header().Add("X-Kaf-MsgMeta", meta)
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Length", strconv.FormatUint(uint64(respSz), 10))
+
+	for _, m := range msgs {
+		if _, err := w.Write(m.data); err != nil {
+			err_("get: failed sending data back", 500, r, w)
+			return
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
+			err_("get: failed sending data back", 500, r, w)
+			return
+		}
+	}
+}
+
+/*    way/
+ * respond in json format - making the assumption that all stored data
+ * is json we wrap it in a JSON array and set the content
+ * type (and content length for efficiency). Tombstones (empty messages)
+ * are sent as null. If metadata is asked for,
+ * each message is wrapped in an object with it's metadata:
+ *    {"num":<num>,"at":<time>,"key":<key>,"headers":{..},"data":<data>}
+ */
+func jsonFormat(msgs []*msg, withMeta bool, r *http.Request, w http.ResponseWriter) {
+
+	wraps := make([][]byte, len(msgs))
+	respSz := len("[]")
+	for i, m := range msgs {
+		if i != 0 {
+			respSz += len(",\n")
+		}
+		if withMeta {
+			wraps[i] = []byte("{" + jsonMeta(m) + `,"data":`)
+			respSz += len(wraps[i]) + len("}")
+		}
+		if len(m.data) == 0 {
+			respSz += len("null")
+		}
+		respSz += len(m.data)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Content-Length", strconv.FormatUint(uint64(respSz), 10))
+
+	goterr := false
+	wr := func(d []byte) {
+		if goterr {
+			return
+		}
+		if _, err := w.Write(d); err != nil {
+			goterr = true
+			err_("get: failed sending data back", 500, r, w)
+		}
+	}
+
+	wr([]byte("["))
+	for i, m := range msgs {
+		if i != 0 {
+			wr([]byte(",\n"))
+		}
+		if withMeta {
+			wr(wraps[i])
+		}
+		if len(m.data) == 0 {
+			wr([]byte("null"))
+		}
+		wr(m.data)
+		if withMeta {
+			wr([]byte("}"))
+		}
+	}
+	wr([]byte("]"))
+}
+
+/*    way/
+ * the message's metadata as JSON object fields
+ */
+func jsonMeta(m *msg) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `"num":%d`, m.num)
+	if m.meta.at != 0 {
+		at := time.UnixMilli(m.meta.at).UTC().Format(TimeFormat)
+		fmt.Fprintf(&b, `,"at":"%s"`, at)
+	}
+	if len(m.meta.key) > 0 {
+		k, _ := json.Marshal(m.meta.key)
+		fmt.Fprintf(&b, `,"key":%s`, k)
+	}
+	if len(m.meta.hdrs) > 0 {
+		h, _ := json.Marshal(m.meta.hdrs)
+		fmt.Fprintf(&b, `,"headers":%s`, h)
+	}
+	return b.String()
+}
+
+/*    way/
+ * handle /put/<logname> request (with an optional X-Kaf-Key header and
+ * any X-Kaf-Meta-<name> user headers), responding with message number
+ * added to event log. A message with a key may be empty - a tombstone
+ * marking the key as deleted. Producers that send X-Kaf-Producer and
+ * X-Kaf-Seq headers can safely retry - duplicates are responded to
+ * with the message number already given. With ?expect=num the message
+ * is only added if num is still the last message in the log.
+ */
+func put(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/put/"):])
+	if isHidden(name) {
+		err_("put: invalid log name", 400, r, w)
+		return
+	}
+	if isReserved(name) {
+		err_("put: reserved log", 403, r, w)
+		return
+	}
+	logR, err := getLog(name, logsR, true)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
+	}
+
+	var meta recMeta
+	if kv := r.Header["X-Kaf-Key"]; len(kv) > 0 {
+		meta.key = kv[0]
+		if len(meta.key) == 0 || len(meta.key) > MaxKey {
+			err_("put: Invalid message key", 400, r, w)
+			return
+		}
+	}
+	var expect uint64
+	ev := r.URL.Query()["expect"]
+	if len(ev) > 0 {
+		expect, err = strconv.ParseUint(ev[0], 10, 64)
+		if err != nil {
+			err_("put: Invalid 'expect' message number", 400, r, w)
+			return
+		}
+	}
+
+	pv := r.Header["X-Kaf-Producer"]
+	sv := r.Header["X-Kaf-Seq"]
+	if len(pv) > 0 || len(sv) > 0 {
+		if len(pv) == 0 || len(pv[0]) == 0 || len(pv[0]) > MaxKey {
+			err_("put: Invalid or missing producer", 400, r, w)
+			return
+		}
+		if len(sv) == 0 {
+			err_("put: Missing producer sequence number", 400, r, w)
+			return
+		}
+		seq, err := strconv.ParseUint(sv[0], 10, 64)
+		if err != nil {
+			err_("put: Invalid producer sequence number", 400, r, w)
+			return
+		}
+		meta.producer = pv[0]
+		meta.seq = seq
+	}
+	for h, v := range r.Header {
+		if !strings.HasPrefix(h, "X-Kaf-Meta-") || len(h) == len("X-Kaf-Meta-") {
+			continue
+		}
+		if meta.hdrs == nil {
+			meta.hdrs = map[string]string{}
+		}
+		meta.hdrs[strings.ToLower(h[len("X-Kaf-Meta-"):])] = v[0]
+	}
+
+	hsz := r.Header["Content-Length"]
+	if len(hsz) == 0 {
+		err_("put: No content-length found", 400, r, w)
+		return
+	}
+	sz, err := strconv.ParseUint(hsz[0], 10, 64)
+	if err != nil {
+		err_("put: Invalid content-length", 400, r, w)
+		return
+	}
+	if sz <= 0 && len(meta.key) == 0 {
+		err_("put: Empty message length", 400, r, w)
+		return
+	}
+	if sz > 5*1024*1024 {
+		err_("put: too large message length", 400, r, w)
+		return
+	}
+
+	data := make([]byte, sz)
+	if data == nil {
+		err_("put: Out of Memory", 500, r, w)
+		return
+	}
+	if _, err := io.ReadFull(r.Body, data); err != nil {
+		err_("put: failed reading message data", 400, r, w)
+		return
+	}
+
+	c := make(chan putReqResp)
+	err = send(logR, logR.put, putReq{
+		data:   data,
+		meta:   meta,
+		quota:  cfg.logCfg(name).quota,
+		roll:   cfg.logCfg(name).roll,
+		expect: expect,
+		cond:   len(ev) > 0,
+		resp:   c,
+	})
+	if err != nil {
+		err_(err.Error(), 503, r, w)
+		return
+	}
+	resp := <-c
+	if resp.archived > 0 {
+		params := map[string]string{
+			"log":    name,
+			"upto":   strconv.FormatUint(resp.archived, 10),
+			"reason": "quota",
+		}
+		audit(cfg, logsR, "archive", nil, params, nil)
+	}
+	if errors.Is(resp.err, errLogFull) {
+		err_("put: "+resp.err.Error(), 507, r, w)
+		return
+	}
+	if errors.Is(resp.err, errBadSeq) || errors.Is(resp.err, errNotExpected) {
+		w.Header().Add("X-Kaf-LastMsg", strconv.FormatUint(resp.num, 10))
+		err_("put: "+resp.err.Error(), 409, r, w)
+		return
+	}
+	if errors.Is(resp.err, errDuplicate) {
+		w.Header().Add("X-Kaf-Duplicate", "true")
+		resp.err = nil
+	}
+	if resp.err != nil {
+		err_(resp.err.Error(), 500, r, w)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(strconv.FormatUint(resp.num, 10)))
+}
+
+/*    way/
+ * handle /txn/ request - the posted data is a transaction (see
+ * encodeTxn) with messages for several logs. Responds with the message
+ * number given to each message (one per line) once all of them are
+ * saved - or, if any of them can't be, with an error and none of them
+ * saved.
+ */
+func txn(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	hsz := r.Header["Content-Length"]
+	if len(hsz) == 0 {
+		err_("txn: No content-length found", 400, r, w)
+		return
+	}
+	sz, err := strconv.ParseUint(hsz[0], 10, 64)
+	if err != nil || sz == 0 {
+		err_("txn: Invalid content-length", 400, r, w)
+		return
+	}
+	if sz > 5*1024*1024 {
+		err_("txn: too large transaction length", 400, r, w)
+		return
+	}
+
+	data := make([]byte, sz)
+	if _, err := io.ReadFull(r.Body, data); err != nil {
+		err_("txn: failed reading transaction data", 400, r, w)
+		return
+	}
+
+	puts, err := decodeTxn(data)
+	if err != nil {
+		err_("txn: "+err.Error(), 400, r, w)
+		return
+	}
+	if len(puts) == 0 {
+		err_("txn: Empty transaction", 400, r, w)
+		return
+	}
+
+	cfgs := map[string]logCfg{}
+	for i, p := range puts {
+		if isHidden(p.log) || isReserved(p.log) || strings.ContainsAny(p.log, "/\\") {
+			err_("txn: invalid log name", 400, r, w)
+			return
+		}
+		if len(p.data) == 0 && len(p.meta.key) == 0 {
+			err_("txn: Empty message length", 400, r, w)
+			return
+		}
+		puts[i].meta = recMeta{key: p.meta.key, hdrs: p.meta.hdrs}
+		cfgs[p.log] = cfg.logCfg(p.log)
+	}
+
+	c := make(chan txnReqResp)
+	logsR.t <- txnReq{
+		puts: puts,
+		cfgs: cfgs,
+		resp: c,
+	}
+	resp := <-c
+	if errors.Is(resp.err, errLogFull) {
+		err_("txn: "+resp.err.Error(), 507, r, w)
+		return
+	}
+	if resp.err != nil {
+		err_(resp.err.Error(), 500, r, w)
+		return
+	}
+
+	var b strings.Builder
+	for _, num := range resp.nums {
+		b.WriteString(strconv.FormatUint(num, 10))
+		b.WriteString("\n")
+	}
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+/*    way/
+ * handle /archive/<logname>?upto=num request, responding with the
+ * message number actually archived upto
+ */
+func archive(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/archive/"):])
+	if isHidden(name) {
+		err_("archive: invalid log name", 400, r, w)
+		return
+	}
+
+	qv := r.URL.Query()["upto"]
+	if qv == nil || len(qv) == 0 {
+		err_("archive: Missing 'upto' message number", 400, r, w)
+		return
+	}
+	num, err := strconv.ParseUint(qv[0], 10, 64)
+	if err != nil || num < 1 {
+		err_("archive: Invalid 'upto' message number", 400, r, w)
+		return
+	}
+
+	params := map[string]string{"log": name, "upto": qv[0]}
+
+	logR, err := getLog(name, logsR, false)
+	if err != nil || logR == nil {
+		audit(cfg, logsR, "archive", r, params, errors.New("invalid log"))
+		err_("archive: Invalid log", 400, r, w)
+		return
+	}
+
+	c := make(chan achReqResp)
+	if err := send(logR, logR.ach, archiveReq{upto: num, exact: true, compress: cfg.logCfg(name).keep.compressNow, resp: c}); err != nil {
+		err_(err.Error(), 503, r, w)
+		return
+	}
+	resp := <-c
+	if resp.err == errInLogFile {
+		w.Header().Add("X-Kaf-Archivable", strconv.FormatUint(resp.upto, 10))
+		err_("archive: "+resp.err.Error(), 409, r, w)
+		return
+	}
+	params["archived"] = strconv.FormatUint(resp.upto, 10)
+	audit(cfg, logsR, "archive", r, params, resp.err)
+	if resp.err != nil {
+		err_(resp.err.Error(), 500, r, w)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(params["archived"]))
+}
+
+/*    way/
+ * handle /log/<logname> requests (from admins only):
+ *    DELETE ?archive=[true|false] - delete the log, archiving all it's
+ *                                   messages first if asked
+ *    POST ?rename=<new logname>   - rename the log (moving the offsets
+ *                                   committed by it's consumers and
+ *                                   it's lease groups too)
+ *    POST ?copy=<new logname>     - copy the log
+ * responding with the message number archived upto (if archived)
+ */
+func logH(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := logName(r)
+	if isHidden(name) || isReserved(name) || strings.Contains(name, "/") {
+		err_("log: Invalid log name", 400, r, w)
+		return
+	}
+
+	q := r.URL.Query()
+	op, params := "", map[string]string{"log": name}
+	var archive bool
+	var to string
+	switch {
+	case r.Method == "DELETE":
+		op = "delete"
+		archive, _ = strconv.ParseBool(q.Get("archive"))
+		params["archive"] = strconv.FormatBool(archive)
+	case r.Method == "POST" && q.Has("rename"):
+		op, to = "rename", strings.TrimSpace(q.Get("rename"))
+	case r.Method == "POST" && q.Has("copy"):
+		op, to = "copy", strings.TrimSpace(q.Get("copy"))
+	case r.Method == "POST":
+		err_("log: Missing 'rename' or 'copy' log name", 400, r, w)
+		return
+	default:
+		err_("log: Method not allowed", 405, r, w)
+		return
+	}
+	if op != "delete" {
+		if isHidden(to) || isReserved(to) || strings.Contains(to, "/") || to == name {
+			err_("log: Invalid '"+op+"' log name", 400, r, w)
+			return
+		}
+		params["to"] = to
+	}
+
+	if !isAdmin(cfg, r) {
+		audit(cfg, logsR, op, r, params, errNotAdmin)
+		err_("log: "+errNotAdmin.Error(), 403, r, w)
+		return
+	}
+
+	var err error
+	if op == "delete" {
+		c := make(chan deleteReqResp)
+		logsR.d <- deleteReq{name, archive, c}
+		resp := <-c
+		if archive {
+			params["archived"] = strconv.FormatUint(resp.upto, 10)
+		}
+		err = resp.err
+		if err == nil {
+			err = moveState(name, "", logsR)
+		}
+	} else {
+		c := make(chan error)
+		logsR.m <- moveReq{name, to, op == "copy", c}
+		err = <-c
+		if err == nil && op == "rename" {
+			err = moveState(name, to, logsR)
+		}
+	}
+	audit(cfg, logsR, op, r, params, err)
+	switch err {
+	case nil:
+	case errNoLog:
+		err_("log: "+err.Error(), 404, r, w)
+		return
+	case errLogExists:
+		err_("log: "+err.Error(), 409, r, w)
+		return
+	case errLogBusy:
+		err_("log: "+err.Error(), 503, r, w)
+		return
+	default:
+		err_(err.Error(), 500, r, w)
+		return
+	}
+
+	if archive {
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(params["archived"]))
+	}
+}
+
+/*    way/
+ * move the lease groups of a renamed log and the offsets committed by
+ * it's consumers to it's new name - or drop them if the log was deleted
+ * (so a new log with the name starts afresh)
+ *
+ *    understand/
+ * the consumers goroutine saves offsets to the _consumers log (through
+ * the logs goroutine) so we must do this after the logs goroutine is
+ * done with the rename or delete, not from within it
+ */
+func moveState(name, to string, logsR logsRoutine) error {
+	l := make(chan leaseReqResp)
+	logsR.l <- leaseReq{log: name, to: to, resp: l}
+	<-l
+
+	c := make(chan offsetReqResp)
+	logsR.o <- offsetReq{log: name, drop: true, to: to, resp: c}
+	return (<-c).err
+}
+
+/*    way/
+ * handle /archives/<logname> requests:
+ *    GET                          - list the archives of the log
+ *    GET ?name=<archive>          - download the archive
+ *    DELETE ?name=<archive>       - delete the archive (admins only)
+ *    POST ?name=<archive>&restore=<logname>
+ *                                 - restore the archive as a new log
+ *                                   (admins only)
+ */
+func archives(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/archives/"):])
+	if isHidden(name) {
+		err_("archives: invalid log name", 400, r, w)
+		return
+	}
+
+	aname := r.URL.Query().Get("name")
+	if len(aname) == 0 {
+		if r.Method != "GET" {
+			err_("archives: Missing archive 'name'", 400, r, w)
+			return
+		}
+		listArchivesH(name, cfg, r, logsR, w)
+		return
+	}
+
+	n, _, ok := parseArchiveName(aname)
+	if !ok || n != name || filepath.Base(aname) != aname {
+		err_("archives: Invalid archive 'name'", 400, r, w)
+		return
+	}
+
+	op, params := "", map[string]string{"log": name, "archive": aname}
+	restore := strings.TrimSpace(r.URL.Query().Get("restore"))
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		op = "delete"
+	case "POST":
+		op = "restore"
+		if isHidden(restore) || isReserved(restore) || strings.Contains(restore, "/") {
+			err_("archives: Invalid or missing 'restore' log name", 400, r, w)
+			return
+		}
+		params["restore"] = restore
+	default:
+		err_("archives: Method not allowed", 405, r, w)
+		return
+	}
+	if len(op) > 0 && !isAdmin(cfg, r) {
+		audit(cfg, logsR, op, r, params, errNotAdmin)
+		err_("archives: "+errNotAdmin.Error(), 403, r, w)
+		return
+	}
+
+	loc := filepath.Join(cfg.dbloc, aname)
+	if !fileExists(loc) {
+		err_("archives: Archive not found", 404, r, w)
+		return
+	}
+
+	switch op {
+	case "":
+		downloadArchive(loc, r, w)
+	case "delete":
+		err := os.Remove(loc)
+		archivesChanged(name, logsR)
+		audit(cfg, logsR, op, r, params, err)
+		if err != nil {
+			err_(err.Error(), 500, r, w)
+		}
+	case "restore":
+		err := restoreArchive(loc, restore, cfg, logsR)
+		audit(cfg, logsR, op, r, params, err)
+		if err == errLogExists {
+			err_(err.Error(), 409, r, w)
+		} else if err != nil {
+			err_(err.Error(), 500, r, w)
+		}
+	}
+}
+
+/*    way/
+ * respond with the archives of the log - asking the log to list them
+ * (so it can keep their index) or, if the log doesn't exist, listing
+ * them ourselves
+ */
+func listArchivesH(name string, cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	logR, err := getLog(name, logsR, false)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
+	}
+
+	var resp listReqResp
+	if logR != nil {
+		c := make(chan listReqResp)
+		if err := send(logR, logR.lst, listReq{c}); err != nil {
+			err_(err.Error(), 503, r, w)
+			return
+		}
+		resp = <-c
+	} else {
+		resp = list_(&msgLog{name: name, loc: filepath.Join(cfg.dbloc, name)})
+	}
+	if resp.err != nil {
+		err_(resp.err.Error(), 500, r, w)
+		return
+	}
+
+	data, err := json.Marshal(resp.archives)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
+
+/*    way/
+ * stream the archive file to the client. Compressed archives are sent
+ * as they are if the client accepts gzip encoding and uncompressed as
+ * we send them otherwise.
+ *
+ *    understand/
+ * archives can be far bigger than we can send within the server's
+ * write timeout, so we keep pushing the deadline back as long as the
+ * download is making progress
+ */
+func downloadArchive(loc string, r *http.Request, w http.ResponseWriter) {
+	f, err := os.Open(loc)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
+	}
+	defer f.Close()
+	inf, err := f.Stat()
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
+	}
+
+	fname := filepath.Base(loc)
+	var rd io.Reader = f
+	sz := inf.Size()
+	if strings.HasSuffix(fname, ".gz") {
+		fname = strings.TrimSuffix(fname, ".gz")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Add("Content-Encoding", "gzip")
+		} else {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				err_(err.Error(), 500, r, w)
+				return
+			}
+			defer zr.Close()
+			rd = zr
+			sz = -1
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fname))
+	if sz >= 0 {
+		w.Header().Add("Content-Length", strconv.FormatInt(sz, 10))
+	}
+	io.Copy(deadlineWriter{w, http.NewResponseController(w)}, rd)
+}
+
+type deadlineWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (dw deadlineWriter) Write(p []byte) (int, error) {
+	if err := dw.rc.SetWriteDeadline(time.Now().Add(DownloadTimeout)); err != nil {
+		return 0, err
+	}
+	return dw.w.Write(p)
+}
+
+/*    way/
+ * copy the archive (uncompressing it if needed) to a hidden file, check
+ * it loads as a log, then link it in as the new log (which fails if the
+ * log already exists) and load it
+ */
+func restoreArchive(loc, name string, cfg *config, logsR logsRoutine) error {
+	dst := filepath.Join(cfg.dbloc, name)
+	if fileExists(dst) {
+		return errLogExists
+	}
+
+	src, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var rd io.Reader = src
+	if strings.HasSuffix(loc, ".gz") {
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		rd = zr
+	}
+
+	tmp := filepath.Join(cfg.dbloc, "."+name+".restore")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer os.Remove(idxLoc(tmp))
+	_, err = io.Copy(f, rd)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	msglog := &msgLog{name: name, loc: tmp}
+	err = loadLogFile(msglog)
+	clearMsgLog(msglog)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %s", err)
+	}
 
-/*    way/
- * return a mux with our request handlers
- */
-func requestHandlers(cfg *config, lr logsRoutine) *http.ServeMux {
-	wrapH := func(h reqHandler) httpHandler {
-		return func(w http.ResponseWriter, r *http.Request) {
-			h(cfg, r, lr, w)
+	if err := os.Link(tmp, dst); err != nil {
+		if os.IsExist(err) {
+			return errLogExists
 		}
+		return err
 	}
-	mux := http.NewServeMux()
-	mux.HandleFunc("/get/", wrapH(get))
-	mux.HandleFunc("/put/", wrapH(put))
-	mux.HandleFunc("/archive/", wrapH(archive))
-	return mux
+	_, err = getLog(name, logsR, false)
+	return err
 }
 
 /*    way/
- * helper function that requests logsRoutine for the given log
+ * handle /compact/<logname> request, responding with the number of
+ * messages removed
  */
-func getLog(name string, logsR logsRoutine, create bool) (*logRoutine, error) {
-	c := make(chan logReqResp)
-	logsR.c <- logReq{
-		name:   name,
-		create: create,
-		resp:   c,
+func compact(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/compact/"):])
+	if isHidden(name) {
+		err_("compact: invalid log name", 400, r, w)
+		return
 	}
-	resp := <-c
-	return resp.logR, resp.err
+
+	logR, err := getLog(name, logsR, false)
+	if err != nil || logR == nil {
+		audit(cfg, logsR, "compact", r, map[string]string{"log": name}, errors.New("invalid log"))
+		err_("compact: Invalid log", 400, r, w)
+		return
+	}
+
+	removed, err := compactLog(cfg, logsR, logR, r)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(strconv.FormatUint(removed, 10)))
 }
 
 /*    way/
- * handle /get/<logname>?from=num&format=[kaf|raw|json] request, responding
- * with messages from the event log
+ * handle /commit/<logname>?consumer=<name>&upto=num request, saving the
+ * message number the consumer has read (and handled) upto so it can
+ * continue from there with from=committed
  */
-func get(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
-	name := strings.TrimSpace(r.URL.Path[len("/get/"):])
+func commit(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/commit/"):])
 	if isHidden(name) {
-		err_("get: invalid log name", 400, r, w)
+		err_("commit: invalid log name", 400, r, w)
 		return
 	}
 
-	qv := r.URL.Query()["from"]
-	if qv == nil || len(qv) == 0 {
-		err_("get: Missing 'from' message number", 400, r, w)
+	consumer := r.URL.Query().Get("consumer")
+	if len(consumer) == 0 || len(consumer) > MaxKey || strings.HasPrefix(consumer, GroupPfx) {
+		err_("commit: Invalid or missing 'consumer'", 400, r, w)
 		return
 	}
-	num, err := strconv.ParseUint(qv[0], 10, 32)
-	if err != nil || num < 1 {
-		err_("get: Invalid 'from' message number", 400, r, w)
+	qv := r.URL.Query()["upto"]
+	if len(qv) == 0 {
+		err_("commit: Missing 'upto' message number", 400, r, w)
+		return
+	}
+	upto, err := strconv.ParseUint(qv[0], 10, 64)
+	if err != nil {
+		err_("commit: Invalid 'upto' message number", 400, r, w)
 		return
 	}
 
@@ -1004,239 +6536,263 @@ func get(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter)
 		err_(err.Error(), 500, r, w)
 		return
 	}
-
-	var msgs []*msg
-	if logR != nil {
-		c := make(chan getReqResp)
-		logR.get <- getReq{
-			num:  uint32(num),
-			resp: c,
-		}
-		resp := <-c
-		if resp.err != nil {
-			err_(resp.err.Error(), 500, r, w)
-			return
-		}
-		msgs = resp.msgs
+	if logR == nil {
+		err_("commit: Invalid log", 400, r, w)
+		return
 	}
-
-	if len(msgs) > 0 {
-		lastmsg := msgs[len(msgs)-1].num
-		w.Header().Add("X-Kaf-LastMsgSent", strconv.FormatUint(uint64(lastmsg), 10))
+	stats, err := peekStats(logR)
+	if err != nil {
+		err_(err.Error(), 503, r, w)
+		return
 	}
-
-	format := "kaf"
-	qv = r.URL.Query()["format"]
-	if len(qv) > 0 {
-		format = qv[0]
+	if upto > stats.lastmsg {
+		err_("commit: 'upto' is beyond the last message", 400, r, w)
+		return
 	}
-	switch format {
-	case "raw":
-		rawFormat(msgs, r, w)
-	case "json":
-		jsonFormat(msgs, r, w)
-	default:
-		kafFormat(msgs, r, w)
+
+	if err := commitOffset(name, consumer, upto, logsR); err != nil {
+		err_(err.Error(), 500, r, w)
+		return
 	}
 }
 
 /*    way/
- * respond in kaf format - with headers and data - setting the content
- * type and content length for efficiency.
+ * handle /lease/<logname>?group=<name>&timeout=<age>&format=[kaf|raw|json]
+ * request, responding with the next message for a worker in the group
+ * (or no messages if there are none to be done). The lease is given in
+ * the X-Kaf-Lease header and the message must be acked before the lease
+ * expires or it will be leased to another worker.
  */
-func kafFormat(msgs []*msg, r *http.Request, w http.ResponseWriter) {
-	respHdr := fmt.Sprintf("%s|%d", RespHeaderPfx, len(msgs))
-	respSz := len(respHdr)
-	msgHdrs := make([][]byte, len(msgs))
-	for i, m := range msgs {
-		msgHdrs[i] = []byte(fmt.Sprintf("%s%d|%d\n", RecHeaderPfx, m.num, m.sz))
-		respSz += len(msgHdrs[i])
-		respSz += len(m.data)
+func lease(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/lease/"):])
+	if isHidden(name) {
+		err_("lease: invalid log name", 400, r, w)
+		return
 	}
-
-	w.Header().Add("Content-Type", "application/octet-stream")
-	w.Header().Add("Content-Length", strconv.FormatUint(uint64(respSz), 10))
-
-	if _, err := w.Write([]byte(respHdr)); err != nil {
-		err_("get: failed sending data back", 500, r, w)
+	group := r.URL.Query().Get("group")
+	if len(group) == 0 || len(group) > MaxKey {
+		err_("lease: Invalid or missing 'group'", 400, r, w)
 		return
 	}
-	for i, m := range msgs {
-		hdr := msgHdrs[i]
-		if _, err := w.Write([]byte(hdr)); err != nil {
-			err_("get: failed sending data back", 500, r, w)
-			return
-		}
-		if _, err := w.Write(m.data); err != nil {
-			err_("get: failed sending data back", 500, r, w)
+	leasing := cfg.logCfg(name).leasing
+	if tv := r.URL.Query()["timeout"]; len(tv) > 0 {
+		timeout, err := parseAge(tv[0])
+		if err != nil || timeout == 0 {
+			err_("lease: Invalid 'timeout'", 400, r, w)
 			return
 		}
+		leasing.timeout = timeout
 	}
-}
-
-/*    way/
- * respond in raw format - just data without headers - setting the content
- * type and content length for efficiency.
- */
-func rawFormat(msgs []*msg, r *http.Request, w http.ResponseWriter) {
-
-	respSz := 0
-	for _, m := range msgs {
-		respSz += len(m.data)
-		respSz += len("\n")
-	}
-
-	w.Header().Add("Content-Type", "application/octet-stream")
-	w.Header().Add("Content-Length", strconv.FormatUint(uint64(respSz), 10))
 
-	for _, m := range msgs {
-		if _, err := w.Write(m.data); err != nil {
-			err_("get: failed sending data back", 500, r, w)
-			return
-		}
-		if _, err := w.Write([]byte("\n")); err != nil {
-			err_("get: failed sending data back", 500, r, w)
-			return
-		}
+	logR, err := getLog(name, logsR, false)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
+		return
 	}
-}
-
-/*    way/
- * respond in json format - making the assumption that all stored data
- * is json we wrap it in a JSON array and set the content
- * type (and content length for efficiency).
- */
-func jsonFormat(msgs []*msg, r *http.Request, w http.ResponseWriter) {
 
-	respSz := len("[]")
-	for i, m := range msgs {
-		if i != 0 {
-			respSz += len(",\n")
+	var msgs []*msg
+	if logR != nil {
+		c := make(chan leaseReqResp)
+		logsR.l <- leaseReq{
+			logR:    logR,
+			group:   group,
+			leasing: leasing,
+			resp:    c,
 		}
-		respSz += len(m.data)
-	}
-
-	w.Header().Add("Content-Type", "application/json")
-	w.Header().Add("Content-Length", strconv.FormatUint(uint64(respSz), 10))
-
-	goterr := false
-	wr := func(d []byte) {
-		if goterr {
+		resp := <-c
+		if resp.err != nil {
+			err_(resp.err.Error(), 500, r, w)
 			return
 		}
-		if _, err := w.Write(d); err != nil {
-			goterr = true
-			err_("get: failed sending data back", 500, r, w)
+		if resp.msg != nil {
+			msgs = append(msgs, resp.msg)
+			w.Header().Add("X-Kaf-Lease", resp.id)
+			w.Header().Add("X-Kaf-LeaseUntil", resp.until.UTC().Format(TimeFormat))
+			w.Header().Add("X-Kaf-Tries", strconv.FormatUint(uint64(resp.tries), 10))
 		}
 	}
 
-	wr([]byte("["))
-	for i, m := range msgs {
-		if i != 0 {
-			wr([]byte(",\n"))
-		}
-		wr(m.data)
-	}
-	wr([]byte("]"))
+	respondMsgs(msgs, r, w)
 }
 
 /*    way/
- * handle /put/<logname> request, responding with message number added
- * to event log
+ * handle /ack/<logname>?group=<name>&num=<msg number>&lease=<lease>
+ * request, marking the leased message done
  */
-func put(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
-	name := strings.TrimSpace(r.URL.Path[len("/put/"):])
+func ack(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	name := strings.TrimSpace(r.URL.Path[len("/ack/"):])
 	if isHidden(name) {
-		err_("put: invalid log name", 400, r, w)
-		return
-	}
-	logR, err := getLog(name, logsR, true)
-	if err != nil {
-		err_(err.Error(), 500, r, w)
-		return
-	}
-
-	hsz := r.Header["Content-Length"]
-	if len(hsz) == 0 {
-		err_("put: No content-length found", 400, r, w)
+		err_("ack: invalid log name", 400, r, w)
 		return
 	}
-	sz, err := strconv.ParseUint(hsz[0], 10, 32)
-	if err != nil {
-		err_("put: Invalid content-length", 400, r, w)
+	group := r.URL.Query().Get("group")
+	if len(group) == 0 {
+		err_("ack: Missing 'group'", 400, r, w)
 		return
 	}
-	if sz <= 0 {
-		err_("put: Empty message length", 400, r, w)
+	id := r.URL.Query().Get("lease")
+	if len(id) == 0 {
+		err_("ack: Missing 'lease'", 400, r, w)
 		return
 	}
-	if sz > 5*1024*1024 {
-		err_("put: too large message length", 400, r, w)
+	num, err := strconv.ParseUint(r.URL.Query().Get("num"), 10, 64)
+	if err != nil || num < 1 {
+		err_("ack: Invalid or missing 'num' message number", 400, r, w)
 		return
 	}
 
-	data := make([]byte, sz)
-	if data == nil {
-		err_("put: Out of Memory", 500, r, w)
+	logR, err := getLog(name, logsR, false)
+	if err != nil {
+		err_(err.Error(), 500, r, w)
 		return
 	}
-	if _, err := io.ReadFull(r.Body, data); err != nil {
-		err_("put: failed reading message data", 400, r, w)
+	if logR == nil {
+		err_("ack: Invalid log", 400, r, w)
 		return
 	}
 
-	c := make(chan putReqResp)
-	logR.put <- putReq{
-		data: data,
-		resp: c,
+	c := make(chan leaseReqResp)
+	logsR.l <- leaseReq{
+		logR:  logR,
+		group: group,
+		ack:   true,
+		num:   num,
+		id:    id,
+		resp:  c,
 	}
 	resp := <-c
+	if resp.err == errNotLeased {
+		err_(resp.err.Error(), 409, r, w)
+		return
+	}
 	if resp.err != nil {
 		err_(resp.err.Error(), 500, r, w)
 		return
 	}
-
-	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(strconv.FormatUint(uint64(resp.num), 10)))
 }
 
 /*    way/
- * handle /archive/<logname>?upto=num request
+ * handle /stats and /stats/<logname> requests, responding with the
+ * last message of every log (or just the one) and the offset committed
+ * and lag of each of it's consumers. For closed logs we use the last
+ * message they had when closed, and for logs that haven't been opened
+ * yet we peek at their log file rather than opening them.
  */
-func archive(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
-	name := strings.TrimSpace(r.URL.Path[len("/archive/"):])
-	if isHidden(name) {
-		err_("archive: invalid log name", 400, r, w)
-		return
+func logStats(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	type consumerStat struct {
+		Name      string `json:"name"`
+		Committed uint64 `json:"committed"`
+		Lag       uint64 `json:"lag"`
+	}
+	type logStat struct {
+		Name      string         `json:"name"`
+		Last      uint64         `json:"last"`
+		Consumers []consumerStat `json:"consumers,omitempty"`
 	}
 
-	qv := r.URL.Query()["upto"]
-	if qv == nil || len(qv) == 0 {
-		err_("archive: Missing 'upto' message number", 400, r, w)
-		return
+	lasts := map[string]uint64{}
+	name := logName(r)
+	if len(name) > 0 {
+		logR, err := getLog(name, logsR, false)
+		if err != nil {
+			err_(err.Error(), 500, r, w)
+			return
+		}
+		if logR == nil {
+			err_("stats: Invalid log", 400, r, w)
+			return
+		}
+		stats, err := peekStats(logR)
+		if err != nil {
+			err_(err.Error(), 503, r, w)
+			return
+		}
+		lasts[name] = stats.lastmsg
+	} else {
+		names, err := logNames(cfg.dbloc)
+		if err != nil {
+			err_(err.Error(), 500, r, w)
+			return
+		}
+		logRs, closed := logsR.reg.all()
+		for _, logR := range logRs {
+			if stats, err := peekStats(logR); err == nil {
+				lasts[logR.name] = stats.lastmsg
+			}
+		}
+		for name, meta := range closed {
+			lasts[name] = meta.lastmsg
+		}
+		for _, name := range names {
+			if _, ok := lasts[name]; ok {
+				continue
+			}
+			last, err := peekLast(filepath.Join(cfg.dbloc, name))
+			if err != nil {
+				err_(err.Error(), 500, r, w)
+				return
+			}
+			lasts[name] = last
+		}
 	}
-	num, err := strconv.ParseUint(qv[0], 10, 32)
-	if err != nil || num < 1 {
-		err_("archive: Invalid 'upto' message number", 400, r, w)
-		return
+
+	offsets := getOffsets(logsR)
+	logstats := []logStat{}
+	for name, last := range lasts {
+		ls := logStat{Name: name, Last: last}
+		for consumer, upto := range offsets[name] {
+			ls.Consumers = append(ls.Consumers,
+				consumerStat{consumer, upto, lag(last, upto)})
+		}
+		sort.Slice(ls.Consumers, func(i, j int) bool {
+			return ls.Consumers[i].Name < ls.Consumers[j].Name
+		})
+		logstats = append(logstats, ls)
 	}
+	sort.Slice(logstats, func(i, j int) bool {
+		return logstats[i].Name < logstats[j].Name
+	})
 
-	logR, err := getLog(name, logsR, false)
-	if err != nil || logR == nil {
-		err_("archive: Invalid log", 400, r, w)
+	data, err := json.Marshal(map[string][]logStat{"logs": logstats})
+	if err != nil {
+		err_(err.Error(), 500, r, w)
 		return
 	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
 
-	c := make(chan achReqResp)
-	logR.ach <- archiveReq{
-		upto: uint32(num),
-		resp: c,
+/*    way/
+ * handle POST /promote?force=[true|false] request (from admins only) -
+ * catching up with the leader we are following and then taking over
+ * from it (even if we couldn't catch up, when forced)
+ */
+func promote(cfg *config, r *http.Request, logsR logsRoutine, w http.ResponseWriter) {
+	if r.Method != "POST" {
+		err_("promote: Method not allowed", 405, r, w)
+		return
 	}
-	resp := <-c
-	if resp.err != nil {
-		err_(resp.err.Error(), 500, r, w)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	params := map[string]string{"leader": cfg.follow, "force": strconv.FormatBool(force)}
+	if !isAdmin(cfg, r) {
+		audit(cfg, logsR, "promote", r, params, errNotAdmin)
+		err_("promote: "+errNotAdmin.Error(), 403, r, w)
+		return
+	}
+	if !following(cfg, logsR) {
+		err_("promote: Not following a leader", 400, r, w)
 		return
 	}
+
+	c := make(chan error)
+	logsR.f <- promoteReq{force, c}
+	err := <-c
+	audit(cfg, logsR, "promote", r, params, err)
+	if errors.Is(err, errBehind) {
+		err_("promote: "+err.Error()+" - use force=true to promote anyway", 503, r, w)
+	} else if err != nil {
+		err_(err.Error(), 500, r, w)
+	}
 }
 
 /*    way/
@@ -1252,6 +6808,59 @@ func err_(error string, code int, r *http.Request, w http.ResponseWriter) {
 type config struct {
 	addr  string
 	dbloc string
+	file  string
+
+	tokens   map[string]string
+	admins   map[string]bool
+	client   limits
+	idle     time.Duration
+	redirect bool
+	follow   string
+	ftoken   string
+	logs     map[string]logCfg
+	deflog   logCfg
+}
+
+type logCfg struct {
+	limits       limits
+	quota        quota
+	keep         keep
+	compact      bool
+	leasing      leasing
+	readArchives bool
+	roll         rolling
+}
+
+type limits struct {
+	rps float64
+	bps float64
+}
+
+type quota struct {
+	size     int64
+	msgs     uint64
+	archive  bool
+	compress bool
+}
+
+type keep struct {
+	size          int64
+	msgs          uint64
+	age           time.Duration
+	compressAfter time.Duration
+	compressNow   bool
+	deleteAfter   time.Duration
+}
+
+type rolling struct {
+	size int64
+	age  time.Duration
+}
+
+type leasing struct {
+	timeout time.Duration
+	retries uint32
+	dead    string
 }
 
 type reqHandler func(*config, *http.Request, logsRoutine, http.ResponseWriter)
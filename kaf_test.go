@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*    understand/
+ * a kaf instance running in a test server with it's own data folder
+ */
+type instance struct {
+	srv   *httptest.Server
+	logsR logsRoutine
+}
+
+func startInstance(t *testing.T, settings string) *instance {
+	t.Helper()
+	return startInstanceIn(t, t.TempDir(), settings)
+}
+
+func startInstanceIn(t *testing.T, dir, settings string) *instance {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "kaf.cfg")
+	if err := os.WriteFile(file, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(&config{dbloc: dir, file: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs := &atomic.Pointer[config]{}
+	cfgs.Store(cfg)
+
+	lim := getLimiter()
+	logsR := getLogsRoutine(cfgs, lim)
+	srv := httptest.NewServer(requestHandlers(cfgs, logsR, lim))
+	t.Cleanup(srv.Close)
+	return &instance{srv, logsR}
+}
+
+/*    way/
+ * make the request as the admin, returning the status and body
+ */
+func (in *instance) do(t *testing.T, method, path, key, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, in.srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if len(key) > 0 {
+		req.Header.Set("X-Kaf-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func (in *instance) put(t *testing.T, name, key, data string) {
+	t.Helper()
+	if code, body := in.do(t, "POST", "/put/"+name, key, data); code != 200 {
+		t.Fatalf("put %s: %d %s", name, code, body)
+	}
+}
+
+/*    way/
+ * get all the messages in the log (a few at a time)
+ */
+func (in *instance) msgs(t *testing.T, name string) []*msg {
+	t.Helper()
+	var all []*msg
+	var from uint64 = 1
+	for {
+		code, body := in.do(t, "GET", "/get/"+name+"?from="+strconv.FormatUint(from, 10)+"&meta=true", "", "")
+		if code != 200 {
+			t.Fatalf("get %s: %d %s", name, code, body)
+		}
+		msgs, err := readKafMsgs(bufio.NewReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 {
+			return all
+		}
+		all = append(all, msgs...)
+		from = msgs[len(msgs)-1].num + 1
+	}
+}
+
+func (in *instance) nums(t *testing.T, name string) []uint64 {
+	t.Helper()
+	var nums []uint64
+	for _, m := range in.msgs(t, name) {
+		nums = append(nums, m.num)
+	}
+	return nums
+}
+
+func (in *instance) data(t *testing.T, name string) []string {
+	t.Helper()
+	var data []string
+	for _, m := range in.msgs(t, name) {
+		data = append(data, string(m.data))
+	}
+	return data
+}
+
+/*    way/
+ * write a log directly to the data folder (as if an instance had left
+ * it behind)
+ */
+func writeLog(t *testing.T, dir, name string, puts ...txnPut) {
+	t.Helper()
+	loc := filepath.Join(dir, name)
+	if err := createLogFile(loc, 0); err != nil {
+		t.Fatal(err)
+	}
+	logR, err := loadLogR(name, loc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range puts {
+		c := make(chan putReqResp)
+		logR.put <- putReq{data: p.data, meta: p.meta, resp: c}
+		if resp := <-c; resp.err != nil {
+			t.Fatal(resp.err)
+		}
+	}
+	c := make(chan stopReqResp)
+	logR.stop <- stopReq{0, c}
+	<-c
+}
+
+/*    way/
+ * get the last message of each log and the offsets committed by it's
+ * consumers (as <log>/<consumer>)
+ */
+func (in *instance) stats(t *testing.T) map[string]uint64 {
+	t.Helper()
+	code, body := in.do(t, "GET", "/stats", "", "")
+	if code != 200 {
+		t.Fatalf("stats: %d %s", code, body)
+	}
+	var resp struct {
+		Logs []struct {
+			Name      string `json:"name"`
+			Last      uint64 `json:"last"`
+			Consumers []struct {
+				Name      string `json:"name"`
+				Committed uint64 `json:"committed"`
+			} `json:"consumers"`
+		} `json:"logs"`
+	}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	stats := map[string]uint64{}
+	for _, l := range resp.Logs {
+		stats[l.Name] = l.Last
+		for _, c := range l.Consumers {
+			stats[l.Name+"/"+c.Name] = c.Committed
+		}
+	}
+	return stats
+}
+
+/*    way/
+ * wait for the instance's stats to have (at least) the given values
+ */
+func (in *instance) waitFor(t *testing.T, want map[string]uint64) {
+	t.Helper()
+	var stats map[string]uint64
+	for end := time.Now().Add(10 * time.Second); time.Now().Before(end); {
+		stats = in.stats(t)
+		ok := true
+		for k, v := range want {
+			if stats[k] != v {
+				ok = false
+			}
+		}
+		if ok {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("wanted %v, have %v", want, stats)
+}
+
+func equal[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*    understand/
+ * a follower catches up with the leader (keeping the leader's message
+ * numbers - even where the leader has compacted messages away),
+ * replays committed offsets, only serves reads, and takes over writes
+ * once promoted
+ */
+func TestFollow(t *testing.T) {
+	leader := startInstance(t, "token.admin = s3cret\ntoken.rep = r3p\nadmin = admin\n")
+
+	for _, m := range []string{"o1", "o2", "o3"} {
+		leader.put(t, "orders", "", m)
+	}
+	for _, k := range []string{"b", "a", "a", "c"} {
+		leader.put(t, "keyed", k, k)
+	}
+	if code, body := leader.do(t, "POST", "/compact/keyed", "", ""); code != 200 || body != "1" {
+		t.Fatalf("compact: %d %s", code, body)
+	}
+	if code, body := leader.do(t, "POST", "/commit/orders?consumer=billing&upto=2", "", ""); code != 200 {
+		t.Fatalf("commit: %d %s", code, body)
+	}
+
+	follower := startInstance(t, "token.admin = s3cret\nadmin = admin\nfollow = "+leader.srv.URL+"\nfollow.token = r3p\n")
+	follower.waitFor(t, map[string]uint64{"orders": 3, "keyed": 4, "orders/billing": 2})
+
+	if nums := follower.nums(t, "keyed"); !equal(nums, []uint64{1, 3, 4}) {
+		t.Errorf("keyed: wanted messages [1 3 4], have %v", nums)
+	}
+	if code, _ := follower.do(t, "POST", "/put/orders", "", "o4"); code != 403 {
+		t.Errorf("put to follower: wanted 403, have %d", code)
+	}
+
+	leader.put(t, "orders", "", "o4")
+	leader.do(t, "POST", "/commit/orders?consumer=billing&upto=4", "", "")
+	follower.waitFor(t, map[string]uint64{"orders": 4, "orders/billing": 4})
+
+	leader.put(t, "orders", "", "o5")
+	if code, body := follower.do(t, "POST", "/promote", "", ""); code != 200 {
+		t.Fatalf("promote: %d %s", code, body)
+	}
+	if last := follower.stats(t)["orders"]; last != 5 {
+		t.Errorf("promote: wanted to catch up to 5, have %d", last)
+	}
+	follower.put(t, "orders", "", "o6")
+	if nums := follower.nums(t, "orders"); !equal(nums, []uint64{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("orders: wanted messages 1-6, have %v", nums)
+	}
+}
+
+/*    understand/
+ * a follower that can't reach it's leader is only promoted when forced
+ */
+func TestPromoteForce(t *testing.T) {
+	leader := startInstance(t, "token.rep = r3p\n")
+	url := leader.srv.URL
+	leader.srv.Close()
+
+	follower := startInstance(t, "token.admin = s3cret\nadmin = admin\nfollow = "+url+"\nfollow.token = r3p\n")
+	if code, _ := follower.do(t, "POST", "/promote", "", ""); code != 503 {
+		t.Errorf("promote: wanted 503, have %d", code)
+	}
+	if code, body := follower.do(t, "POST", "/promote?force=true", "", ""); code != 200 {
+		t.Errorf("promote forced: %d %s", code, body)
+	}
+	follower.put(t, "orders", "", "o1")
+}
+
+/*    understand/
+ * deleting (and archiving) a log with a prepared transaction is refused
+ * instead of holding up every other log being opened
+ */
+func TestDeleteDuringTxn(t *testing.T) {
+	in := startInstance(t, "token.admin = s3cret\nadmin = admin\n")
+	in.put(t, "a", "", "x")
+	logR, err := getLog("a", in.logsR, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepared := make(chan error)
+	next := make(chan commitReq)
+	logR.txn <- prepareReq{puts: []txnPut{{log: "a", data: []byte("y")}}, resp: prepared, next: next}
+	if err := <-prepared; err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := make(chan deleteReqResp)
+	go func() { in.logsR.d <- deleteReq{"a", true, deleted} }()
+	select {
+	case resp := <-deleted:
+		if resp.err != errLogBusy {
+			t.Errorf("delete: wanted %v, have %v", errLogBusy, resp.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delete: waited on the transaction")
+	}
+	if _, err := getLog("b", in.logsR, true); err != nil {
+		t.Fatal(err)
+	}
+
+	committed := make(chan txnPutsResp)
+	next <- commitReq{commit: true, resp: committed}
+	<-committed
+}
+
+/*    understand/
+ * a transaction left pending (here with only it's first message
+ * committed) is finished when we start - skipping the messages already
+ * committed, following logs that have been renamed, and dropping the
+ * messages of logs that have been deleted
+ */
+func TestTxnRecovery(t *testing.T) {
+	dir := t.TempDir()
+	puts := []txnPut{
+		{log: "a", data: []byte("a1")},
+		{log: "a", data: []byte("a2")},
+		{log: "b", data: []byte("b1")},
+		{log: "old", data: []byte("c1")},
+		{log: "gone", data: []byte("d1")},
+	}
+	writeLog(t, dir, TxnLog, txnPut{data: encodeTxn(puts)})
+	writeLog(t, dir, "a", txnPut{data: []byte("a1"), meta: recMeta{txn: 1}})
+	writeLog(t, dir, "b")
+	writeLog(t, dir, "new", txnPut{data: []byte("n1")})
+	if err := saveRename("old", "new", &registry{renamed: map[string]string{}}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	in := startInstanceIn(t, dir, "token.admin = s3cret\nadmin = admin\n")
+	for name, want := range map[string][]string{
+		"a":   {"a1", "a2"},
+		"b":   {"b1"},
+		"new": {"n1", "c1"},
+	} {
+		if data := in.data(t, name); !equal(data, want) {
+			t.Errorf("%s: wanted %v, have %v", name, want, data)
+		}
+		for _, m := range in.msgs(t, name) {
+			if m.meta.txn != 1 && string(m.data) != "n1" {
+				t.Errorf("%s: message %d not marked with the transaction", name, m.num)
+			}
+		}
+	}
+	if fileExists(filepath.Join(dir, "gone")) {
+		t.Error("gone: deleted log was created again")
+	}
+	if pending, err := pendingTxns(in.logsR); err != nil || len(pending) != 0 {
+		t.Errorf("wanted no pending transactions, have %v (%v)", pending, err)
+	}
+}